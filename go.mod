@@ -3,9 +3,12 @@ module github.com/mickael-menu/tesh
 go 1.17
 
 require (
-	github.com/aymerick/raymond v2.0.2+incompatible // indirect
-	github.com/google/go-cmp v0.5.6 // indirect
-	github.com/kr/text v0.2.0 // indirect
-	github.com/mickael-menu/pretty v0.2.3 // indirect
-	github.com/rogpeppe/go-internal v1.8.1 // indirect
+	github.com/BurntSushi/toml v1.2.1
+	github.com/aymerick/raymond v2.0.2+incompatible
+	github.com/google/go-cmp v0.5.6
+	github.com/mickael-menu/pretty v0.2.3
+	github.com/rogpeppe/go-internal v1.8.1
+	gopkg.in/yaml.v2 v2.4.0
 )
+
+require github.com/kr/text v0.2.0 // indirect
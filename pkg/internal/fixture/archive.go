@@ -0,0 +1,337 @@
+package fixture
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mickael-menu/tesh/pkg/internal/util/errors"
+	"github.com/rogpeppe/go-internal/txtar"
+)
+
+var archiveExts = []string{".tar", ".tar.gz", ".tgz", ".zip", ".txtar"}
+
+// IsArchive returns whether the given path is a supported archive, according
+// to its extension.
+func IsArchive(path string) bool {
+	return archiveExt(path) != ""
+}
+
+func archiveExt(path string) string {
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(path, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// Install installs the fixture at sourcePath into targetDir. The fixture is
+// either a directory, or an archive which is extracted.
+func (i Installer) Install(sourcePath string, targetDir string) error {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return i.CopyDir(sourcePath, targetDir)
+	}
+	return i.Extract(sourcePath, targetDir)
+}
+
+// Extract extracts the content of the archive at archivePath into
+// targetDir, preserving the permissions, links and modification times of
+// its entries. Existing files in targetDir are replaced.
+func (i Installer) Extract(archivePath string, targetDir string) error {
+	x := &extraction{installer: i, targetDir: targetDir}
+
+	var err error
+	switch archiveExt(archivePath) {
+	case ".tar":
+		err = x.extractTar(archivePath, false)
+	case ".tar.gz", ".tgz":
+		err = x.extractTar(archivePath, true)
+	case ".zip":
+		err = x.extractZip(archivePath)
+	case ".txtar":
+		err = x.extractTxtar(archivePath)
+	default:
+		err = fmt.Errorf("unsupported archive format")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "extract %s", archivePath)
+	}
+	return x.finish()
+}
+
+// extraction writes the entries of an archive in a target directory.
+type extraction struct {
+	installer Installer
+	targetDir string
+	// The attributes of the directories are set after extracting their
+	// content, in case they are read-only.
+	dirs []extractedDir
+}
+
+type extractedDir struct {
+	path  string
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (x *extraction) extractTar(path string, gzipped bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if gzipped {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(header.Name, mode, header.ModTime)
+		case tar.TypeReg:
+			err = x.file(header.Name, tarReader, mode, header.ModTime)
+		case tar.TypeSymlink:
+			err = x.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = x.hardlink(header.Name, header.Linkname)
+		case tar.TypeFifo:
+			err = x.fifo(header.Name, mode, header.ModTime)
+		case tar.TypeXGlobalHeader:
+			// Metadata written by `git archive`, for example.
+			continue
+		default:
+			err = fmt.Errorf("unsupported file type: %c", header.Typeflag)
+		}
+		if err != nil {
+			return errors.Wrap(err, header.Name)
+		}
+	}
+}
+
+func (x *extraction) extractZip(path string) error {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		err := x.extractZipFile(file)
+		if err != nil {
+			return errors.Wrap(err, file.Name)
+		}
+	}
+	return nil
+}
+
+func (x *extraction) extractZipFile(file *zip.File) error {
+	mode := file.Mode()
+	if mode.IsDir() {
+		return x.dir(file.Name, mode, file.Modified)
+	}
+
+	content, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	switch {
+	case mode&os.ModeSymlink != 0:
+		link, err := ioutil.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		return x.symlink(file.Name, string(link))
+	case mode.IsRegular():
+		return x.file(file.Name, content, mode, file.Modified)
+	default:
+		return fmt.Errorf("unsupported file type: %s", mode.Type())
+	}
+}
+
+// extractTxtar extracts the files of a txtar archive, described in
+// https://pkg.go.dev/golang.org/x/tools/txtar. Files ending with a slash
+// are extracted as empty directories.
+func (x *extraction) extractTxtar(path string) error {
+	archive, err := txtar.ParseFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range archive.Files {
+		if strings.HasSuffix(file.Name, "/") {
+			err = x.dir(file.Name, 0755|os.ModeDir, info.ModTime())
+		} else {
+			err = x.file(file.Name, bytes.NewReader(file.Data), 0644, info.ModTime())
+		}
+		if err != nil {
+			return errors.Wrap(err, file.Name)
+		}
+	}
+	return nil
+}
+
+// path returns the target path of an archive entry, making sure it doesn't
+// escape the target directory.
+func (x *extraction) path(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if isOutside(clean) {
+		return "", errOutside
+	}
+	path := filepath.Join(x.targetDir, clean)
+	// A previous entry might be a symlink to a directory outside of the
+	// target directory.
+	if err := x.checkParent(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	return path, os.MkdirAll(filepath.Dir(path), 0755)
+}
+
+var errOutside = errors.New("entry outside of the target directory")
+
+// isOutside returns whether the clean relative path escapes its parent.
+func isOutside(path string) bool {
+	return filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// checkParent returns an error if the deepest existing directory of dir
+// resolves outside of the target directory.
+func (x *extraction) checkParent(dir string) error {
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(x.targetDir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || isOutside(rel) {
+		return errOutside
+	}
+	return nil
+}
+
+func (x *extraction) dir(name string, mode os.FileMode, mtime time.Time) error {
+	path, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if path == filepath.Clean(x.targetDir) {
+		return nil
+	}
+	x.dirs = append(x.dirs, extractedDir{path: path, mode: mode, mtime: mtime})
+	return mkdir(path)
+}
+
+func (x *extraction) file(name string, content io.Reader, mode os.FileMode, mtime time.Time) error {
+	path, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if x.installer.Render == nil || filepath.Ext(path) != TemplateExt {
+		return writeFile(path, content, mode, mtime)
+	}
+
+	template, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	rendered, err := x.installer.Render(string(template))
+	if err != nil {
+		return err
+	}
+	return writeFile(strings.TrimSuffix(path, TemplateExt), strings.NewReader(rendered), mode, mtime)
+}
+
+func (x *extraction) symlink(name string, link string) error {
+	path, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if err := removeFile(path); err != nil {
+		return err
+	}
+	return os.Symlink(link, path)
+}
+
+func (x *extraction) hardlink(name string, linkname string) error {
+	path, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	target, err := x.path(linkname)
+	if err != nil {
+		return err
+	}
+	if err := removeFile(path); err != nil {
+		return err
+	}
+	return os.Link(target, path)
+}
+
+func (x *extraction) fifo(name string, mode os.FileMode, mtime time.Time) error {
+	path, err := x.path(name)
+	if err != nil {
+		return err
+	}
+	if err := removeFile(path); err != nil {
+		return err
+	}
+	if err := mkfifo(path, mode.Perm()); err != nil {
+		return err
+	}
+	return setAttributes(path, mode, mtime)
+}
+
+func (x *extraction) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		dir := x.dirs[i]
+		if err := setAttributes(dir.path, dir.mode, dir.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package fixture
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mickael-menu/tesh/pkg/internal/util/test/assert"
+)
+
+func TestExtractTar(t *testing.T) {
+	for _, name := range []string{"fixture.tar", "fixture.tar.gz", "fixture.tgz"} {
+		mtime := time.Date(2021, 12, 28, 10, 16, 0, 0, time.UTC)
+		archive := filepath.Join(t.TempDir(), name)
+		writeTar(t, archive, []*tar.Header{
+			{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "abc123"}},
+			{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0750, ModTime: mtime},
+			{Typeflag: tar.TypeReg, Name: "dir/script.sh", Mode: 0755, ModTime: mtime, Size: 10},
+			{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "dir/script.sh", ModTime: mtime},
+			{Typeflag: tar.TypeLink, Name: "hardlink", Linkname: "dir/script.sh", ModTime: mtime},
+		}, "#!/bin/sh\n")
+
+		target := t.TempDir()
+		err := Installer{}.Install(archive, target)
+		assert.Nil(t, err)
+
+		assertFile(t, filepath.Join(target, "dir", "script.sh"), "#!/bin/sh\n", 0755, mtime)
+		assertFile(t, filepath.Join(target, "hardlink"), "#!/bin/sh\n", 0755, mtime)
+		info, err := os.Stat(filepath.Join(target, "dir"))
+		assert.Nil(t, err)
+		assert.Equal(t, info.Mode().Perm(), os.FileMode(0750))
+		assert.True(t, info.ModTime().Equal(mtime))
+		link, err := os.Readlink(filepath.Join(target, "link"))
+		assert.Nil(t, err)
+		assert.Equal(t, link, "dir/script.sh")
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	mtime := time.Date(2021, 12, 28, 10, 16, 0, 0, time.UTC)
+	archive := filepath.Join(t.TempDir(), "fixture.zip")
+	file, err := os.Create(archive)
+	assert.Nil(t, err)
+	writer := zip.NewWriter(file)
+	header := &zip.FileHeader{Name: "dir/config.toml.tpl", Method: zip.Deflate, Modified: mtime}
+	header.SetMode(0640)
+	entry, err := writer.CreateHeader(header)
+	assert.Nil(t, err)
+	_, err = entry.Write([]byte("dir = '{{dir}}'\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+	assert.Nil(t, file.Close())
+
+	target := t.TempDir()
+	err = Installer{
+		Render: func(template string) (string, error) {
+			return strings.ReplaceAll(template, "{{dir}}", target), nil
+		},
+	}.Install(archive, target)
+	assert.Nil(t, err)
+
+	assertFile(t, filepath.Join(target, "dir", "config.toml"), "dir = '"+target+"'\n", 0640, mtime)
+}
+
+func TestExtractTxtar(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "fixture.txtar")
+	content := `Some comment.
+-- hello.txt --
+hello
+-- dir/nested.txt --
+nested
+-- empty/ --
+`
+	assert.Nil(t, ioutil.WriteFile(archive, []byte(content), 0644))
+
+	target := t.TempDir()
+	// Existing files are replaced.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(target, "hello.txt"), []byte("old"), 0644))
+
+	err := Installer{}.Install(archive, target)
+	assert.Nil(t, err)
+
+	assertContent(t, filepath.Join(target, "hello.txt"), "hello\n")
+	assertContent(t, filepath.Join(target, "dir", "nested.txt"), "nested\n")
+	info, err := os.Stat(filepath.Join(target, "empty"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestExtractRejectsEntriesOutsideTarget(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "fixture.txtar")
+	assert.Nil(t, ioutil.WriteFile(archive, []byte("-- ../escape.txt --\nboo\n"), 0644))
+
+	target := filepath.Join(t.TempDir(), "target")
+	assert.Nil(t, os.Mkdir(target, 0755))
+	err := Installer{}.Install(archive, target)
+	assert.Err(t, err, "../escape.txt: entry outside of the target directory")
+
+	_, err = os.Stat(filepath.Join(target, "..", "escape.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExtractRejectsEntriesThroughSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	archive := filepath.Join(t.TempDir(), "fixture.tar")
+	writeTar(t, archive, []*tar.Header{
+		{Typeflag: tar.TypeSymlink, Name: "dir", Linkname: outside},
+		{Typeflag: tar.TypeReg, Name: "dir/sub/escape.txt", Mode: 0644, Size: 4},
+	}, "boo\n")
+
+	err := Installer{}.Install(archive, t.TempDir())
+	assert.Err(t, err, "dir/sub/escape.txt: entry outside of the target directory")
+
+	_, err = os.Stat(filepath.Join(outside, "sub"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIsArchive(t *testing.T) {
+	assert.True(t, IsArchive("fixture.tar"))
+	assert.True(t, IsArchive("fixture.tar.gz"))
+	assert.True(t, IsArchive("fixture.tgz"))
+	assert.True(t, IsArchive("fixture.zip"))
+	assert.True(t, IsArchive("fixture.txtar"))
+	assert.False(t, IsArchive("fixture"))
+	assert.False(t, IsArchive("fixture.gz"))
+}
+
+// writeTar writes a tar archive with the given entries, compressed if the
+// path ends with a gzip extension. Regular files have the given content.
+func writeTar(t *testing.T, path string, headers []*tar.Header, content string) {
+	file, err := os.Create(path)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	var gzipWriter *gzip.Writer
+	writer := tar.NewWriter(file)
+	if strings.HasSuffix(path, "gz") {
+		gzipWriter = gzip.NewWriter(file)
+		writer = tar.NewWriter(gzipWriter)
+	}
+	for _, header := range headers {
+		assert.Nil(t, writer.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := writer.Write([]byte(content))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, writer.Close())
+	if gzipWriter != nil {
+		assert.Nil(t, gzipWriter.Close())
+	}
+}
+
+func assertContent(t *testing.T, path string, content string) {
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), content)
+}
@@ -0,0 +1,226 @@
+package fixture
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mickael-menu/tesh/pkg/internal/util/errors"
+)
+
+// Strategy is the way regular files are installed from a fixture.
+type Strategy string
+
+const (
+	// Copy duplicates the content of the files.
+	Copy Strategy = "copy"
+	// Hardlink creates hard links to the fixture files, falling back on a
+	// copy when not possible. The fixture files are shared with the working
+	// dir, so they must not be modified in place by the tests.
+	Hardlink Strategy = "hardlink"
+	// Reflink creates copy-on-write clones of the files when supported by
+	// the file system, falling back on a copy.
+	Reflink Strategy = "reflink"
+)
+
+// ParseStrategy returns the Strategy with the given name, defaulting to Copy.
+func ParseStrategy(name string) (Strategy, error) {
+	switch Strategy(name) {
+	case "", Copy:
+		return Copy, nil
+	case Hardlink, Reflink:
+		return Strategy(name), nil
+	default:
+		return Copy, fmt.Errorf("unknown fixture strategy: %s", name)
+	}
+}
+
+// TemplateExt is the extension of the fixture files rendered as templates,
+// which is removed when they are installed.
+const TemplateExt = ".tpl"
+
+// Installer installs the files of fixtures in a working dir.
+type Installer struct {
+	Strategy Strategy
+	// Render returns the content of a template file, if not nil.
+	Render func(template string) (string, error)
+}
+
+// CopyDir copies recursively the content of sourceDir into targetDir,
+// preserving permissions, symbolic links, named pipes and modification
+// times. Existing files in targetDir are replaced, but targetDir itself keeps
+// its own attributes.
+func (i Installer) CopyDir(sourceDir string, targetDir string) error {
+	// The permissions and times of the directories are set after copying
+	// their content, in case they are read-only.
+	dirs := []string{}
+	dirInfos := map[string]os.FileInfo{}
+
+	err := filepath.Walk(sourceDir, func(sourcePath string, info os.FileInfo, err error) error {
+		wrap := errors.Wrapperf("walk %s", sourcePath)
+		if err != nil {
+			return wrap(err)
+		}
+		if sourcePath == sourceDir {
+			return nil
+		}
+		sourceName, err := filepath.Rel(sourceDir, sourcePath)
+		if err != nil {
+			return wrap(err)
+		}
+		targetPath := filepath.Join(targetDir, sourceName)
+
+		if info.IsDir() {
+			dirs = append(dirs, targetPath)
+			dirInfos[targetPath] = info
+			return wrap(mkdir(targetPath))
+		}
+		if i.isTemplate(targetPath, info) {
+			return wrap(i.renderFile(sourcePath, info, strings.TrimSuffix(targetPath, TemplateExt)))
+		}
+		return wrap(CopyFile(sourcePath, info, targetPath, i.Strategy))
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info := dirInfos[dirs[i]]
+		err := setAttributes(dirs[i], info.Mode(), info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i Installer) isTemplate(path string, info os.FileInfo) bool {
+	return i.Render != nil && info.Mode().IsRegular() && filepath.Ext(path) == TemplateExt
+}
+
+// renderFile writes the rendered content of the template at sourcePath.
+func (i Installer) renderFile(sourcePath string, info os.FileInfo, targetPath string) error {
+	template, err := ioutil.ReadFile(sourcePath)
+	if err != nil {
+		return err
+	}
+	content, err := i.Render(string(template))
+	if err != nil {
+		return err
+	}
+	return writeFile(targetPath, strings.NewReader(content), info.Mode(), info.ModTime())
+}
+
+// writeFile writes the given content to targetPath, with the given
+// attributes.
+func writeFile(targetPath string, content io.Reader, mode os.FileMode, mtime time.Time) error {
+	if err := removeFile(targetPath); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return setAttributes(targetPath, mode, mtime)
+}
+
+// CopyFile copies a single non-directory file described by info, replacing
+// any existing file at targetPath.
+func CopyFile(sourcePath string, info os.FileInfo, targetPath string, strategy Strategy) error {
+	if err := removeFile(targetPath); err != nil {
+		return err
+	}
+
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(sourcePath)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, targetPath)
+
+	case mode&os.ModeNamedPipe != 0:
+		if err := mkfifo(targetPath, mode.Perm()); err != nil {
+			return err
+		}
+		return setAttributes(targetPath, mode, info.ModTime())
+
+	case mode.IsRegular():
+		switch strategy {
+		case Hardlink:
+			if os.Link(sourcePath, targetPath) == nil {
+				return nil
+			}
+		case Reflink:
+			if reflinkFile(sourcePath, targetPath) == nil {
+				return setAttributes(targetPath, mode, info.ModTime())
+			}
+			// Removes any partially created clone.
+			if err := removeFile(targetPath); err != nil {
+				return err
+			}
+		}
+		return copyFile(sourcePath, targetPath, mode, info.ModTime())
+
+	default:
+		return fmt.Errorf("unsupported file type: %s", mode.Type())
+	}
+}
+
+func copyFile(sourcePath string, targetPath string, mode os.FileMode, mtime time.Time) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	return writeFile(targetPath, source, mode, mtime)
+}
+
+// mkdir creates a writable directory, if it doesn't already exist.
+func mkdir(path string) error {
+	info, err := os.Lstat(path)
+	if err == nil && info.IsDir() {
+		return os.Chmod(path, info.Mode().Perm()|0700)
+	}
+	if err := removeFile(path); err != nil {
+		return err
+	}
+	return os.Mkdir(path, 0700)
+}
+
+// removeFile removes the non-directory file at path, if any. Existing files
+// are never overwritten in place, as they might be hard links to a fixture.
+func removeFile(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s: cannot replace a directory with a file", path)
+	}
+	return os.Remove(path)
+}
+
+// setAttributes sets the permissions and modification time of the file at
+// path.
+func setAttributes(path string, mode os.FileMode, mtime time.Time) error {
+	mode = mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, mtime, mtime)
+}
@@ -0,0 +1,106 @@
+package fixture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mickael-menu/tesh/pkg/internal/util/test/assert"
+)
+
+func TestCopyDir(t *testing.T) {
+	for _, strategy := range []Strategy{Copy, Hardlink, Reflink} {
+		source := t.TempDir()
+		mtime := time.Date(2021, 12, 28, 10, 16, 0, 0, time.UTC)
+		writeTestFile(t, filepath.Join(source, "script.sh"), "#!/bin/sh\n", 0755, mtime)
+		writeTestFile(t, filepath.Join(source, "readonly", "file"), "hello\n", 0444, mtime)
+		assert.Nil(t, os.Chmod(filepath.Join(source, "readonly"), 0555))
+		assert.Nil(t, os.Symlink("script.sh", filepath.Join(source, "link")))
+		assert.Nil(t, os.Symlink("not-found", filepath.Join(source, "dangling")))
+		defer os.Chmod(filepath.Join(source, "readonly"), 0755)
+
+		target := t.TempDir()
+		// Existing files are replaced.
+		writeTestFile(t, filepath.Join(target, "script.sh"), "old", 0644, time.Now())
+
+		err := Installer{Strategy: strategy}.CopyDir(source, target)
+		assert.Nil(t, err)
+		defer os.Chmod(filepath.Join(target, "readonly"), 0755)
+
+		assertFile(t, filepath.Join(target, "script.sh"), "#!/bin/sh\n", 0755, mtime)
+		assertFile(t, filepath.Join(target, "readonly", "file"), "hello\n", 0444, mtime)
+		info, err := os.Stat(filepath.Join(target, "readonly"))
+		assert.Nil(t, err)
+		assert.Equal(t, info.Mode().Perm(), os.FileMode(0555))
+
+		link, err := os.Readlink(filepath.Join(target, "link"))
+		assert.Nil(t, err)
+		assert.Equal(t, link, "script.sh")
+		link, err = os.Readlink(filepath.Join(target, "dangling"))
+		assert.Nil(t, err)
+		assert.Equal(t, link, "not-found")
+	}
+}
+
+func TestCopyDirNamedPipe(t *testing.T) {
+	source := t.TempDir()
+	assert.Nil(t, mkfifo(filepath.Join(source, "fifo"), 0600))
+
+	target := t.TempDir()
+	err := Installer{Strategy: Copy}.CopyDir(source, target)
+	assert.Nil(t, err)
+
+	info, err := os.Lstat(filepath.Join(target, "fifo"))
+	assert.Nil(t, err)
+	assert.True(t, info.Mode()&os.ModeNamedPipe != 0)
+}
+
+func TestCopyDirTemplates(t *testing.T) {
+	source := t.TempDir()
+	mtime := time.Date(2021, 12, 28, 10, 16, 0, 0, time.UTC)
+	writeTestFile(t, filepath.Join(source, "config.toml.tpl"), "dir = '{{dir}}'\n", 0640, mtime)
+
+	target := t.TempDir()
+	err := Installer{
+		Strategy: Copy,
+		Render: func(template string) (string, error) {
+			return strings.ReplaceAll(template, "{{dir}}", target), nil
+		},
+	}.CopyDir(source, target)
+	assert.Nil(t, err)
+
+	assertFile(t, filepath.Join(target, "config.toml"), "dir = '"+target+"'\n", 0640, mtime)
+	_, err = os.Stat(filepath.Join(target, "config.toml.tpl"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestParseStrategy(t *testing.T) {
+	strategy, err := ParseStrategy("")
+	assert.Nil(t, err)
+	assert.Equal(t, strategy, Copy)
+	strategy, err = ParseStrategy("hardlink")
+	assert.Nil(t, err)
+	assert.Equal(t, strategy, Hardlink)
+	_, err = ParseStrategy("symlink")
+	assert.Err(t, err, "unknown fixture strategy: symlink")
+}
+
+func writeTestFile(t *testing.T, path string, content string, perm os.FileMode, mtime time.Time) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	assert.Nil(t, os.Chmod(path, perm))
+	assert.Nil(t, os.Chtimes(path, mtime, mtime))
+}
+
+func assertFile(t *testing.T, path string, content string, perm os.FileMode, mtime time.Time) {
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), content)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), perm)
+	assert.True(t, info.ModTime().Equal(mtime))
+}
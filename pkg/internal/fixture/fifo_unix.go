@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package fixture
+
+import (
+	"os"
+	"syscall"
+)
+
+func mkfifo(path string, perm os.FileMode) error {
+	return syscall.Mkfifo(path, uint32(perm))
+}
@@ -0,0 +1,10 @@
+package fixture
+
+import (
+	"errors"
+	"os"
+)
+
+func mkfifo(path string, perm os.FileMode) error {
+	return errors.New("named pipes are not supported on this platform")
+}
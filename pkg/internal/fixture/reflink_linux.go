@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package fixture
+
+import (
+	"os"
+	"syscall"
+)
+
+// ioctl request number of FICLONE, from linux/fs.h.
+const ficlone = 0x40049409
+
+// reflinkFile clones the source file with a copy-on-write reflink, supported
+// by file systems such as Btrfs or XFS.
+func reflinkFile(sourcePath string, targetPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, target.Fd(), ficlone, source.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fixture
+
+import "errors"
+
+// reflinkFile is not supported on this platform, the files are copied
+// instead.
+func reflinkFile(sourcePath string, targetPath string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
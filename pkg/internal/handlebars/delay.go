@@ -0,0 +1,79 @@
+package handlebars
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aymerick/raymond"
+)
+
+var delayRegistry = map[string]time.Duration{}
+var delayRegistryCount = 1
+var delayIDRegex = regexp.MustCompile(`tesh-delay-\d+-\d+`)
+
+func init() {
+	// Registers the {{delay}} template helper, which pauses a standard input
+	// stream before writing the rest of it.
+	//
+	// < first line
+	// < {{delay "500ms"}}second line
+	raymond.RegisterHelper("delay", func(duration string) string {
+		delay, err := time.ParseDuration(duration)
+		if err != nil || delay < 0 {
+			panic(fmt.Errorf("invalid delay: `%s`", duration))
+		}
+		return registerDelay(delay)
+	})
+}
+
+func registerDelay(delay time.Duration) string {
+	id := fmt.Sprintf("tesh-delay-%d-%d", delayRegistryCount, time.Now().UnixNano())
+	delayRegistryCount += 1
+	delayRegistry[id] = delay
+	return id
+}
+
+// Chunk is a part of a text written after a delay.
+type Chunk struct {
+	Delay   time.Duration
+	Content string
+}
+
+// SplitDelays splits the given text on the markers inserted by the {{delay}}
+// helper. A trailing delay is kept as an empty chunk, to wait before closing
+// the stream.
+func SplitDelays(s string) []Chunk {
+	chunks := []Chunk{}
+	current := Chunk{}
+	start := 0
+	for _, loc := range delayIDRegex.FindAllStringIndex(s, -1) {
+		delay, ok := delayRegistry[s[loc[0]:loc[1]]]
+		if !ok {
+			continue
+		}
+		current.Content += s[start:loc[0]]
+		start = loc[1]
+		// Consecutive delays are merged.
+		if current.Content != "" {
+			chunks = append(chunks, current)
+			current = Chunk{}
+		}
+		current.Delay += delay
+	}
+	current.Content += s[start:]
+	if current.Content != "" || current.Delay > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// StripDelays removes the markers inserted by the {{delay}} helper from the
+// given text.
+func StripDelays(s string) string {
+	content := ""
+	for _, chunk := range SplitDelays(s) {
+		content += chunk.Content
+	}
+	return content
+}
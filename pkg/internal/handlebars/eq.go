@@ -0,0 +1,12 @@
+package handlebars
+
+import "github.com/aymerick/raymond"
+
+func init() {
+	// Registers the {{eq}} template helper, which compares two values.
+	//
+	// {{#if (eq matrix "zsh")}}zsh{{else}}other shell{{/if}}
+	raymond.RegisterHelper("eq", func(a interface{}, b interface{}) bool {
+		return raymond.Str(a) == raymond.Str(b)
+	})
+}
@@ -3,14 +3,41 @@ package exec
 import (
 	"os"
 	"os/exec"
+	"regexp"
+	"strings"
 )
 
 // CommandFromString returns a Cmd running the given command with $SHELL.
 func CommandFromString(command string, args ...string) *exec.Cmd {
+	return ShellCommand(nil, command, args...)
+}
+
+// ShellCommand returns a Cmd running the given command with a shell, e.g.
+// []string{"bash", "-o", "pipefail"}. It defaults to $SHELL if the shell is
+// empty.
+func ShellCommand(shell []string, command string, args ...string) *exec.Cmd {
+	if len(shell) == 0 {
+		shell = []string{DefaultShell()}
+	}
+	args = append(append(shell[1:len(shell):len(shell)], "-c", command, "--"), args...)
+	return exec.Command(shell[0], args...)
+}
+
+// DefaultShell returns $SHELL, or sh if it is not set.
+func DefaultShell() string {
 	shell := os.Getenv("SHELL")
 	if len(shell) == 0 {
 		shell = "sh"
 	}
-	args = append([]string{"-c", command, "--"}, args...)
-	return exec.Command(shell, args...)
+	return shell
 }
+
+// Quote escapes the given string to be used as a single shell word.
+func Quote(s string) string {
+	if s != "" && safeWordRegex.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+var safeWordRegex = regexp.MustCompile(`^[a-zA-Z0-9_./:=@%+,-]+$`)
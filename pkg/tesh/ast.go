@@ -32,6 +32,50 @@ type TestNode struct {
 	Name     string
 	Path     string
 	Children []Node
+	// Tags declared with the `tags` directive, used to select tests.
+	Tags []string
+	// Skip is set with the `skip` directive, to skip the whole test.
+	Skip Marker
+	// Only is set with the `only` directive. When any test of a suite is
+	// marked with `only`, the other tests are skipped.
+	Only bool
+	// XFail is set with the `xfail` directive, when the test is expected to
+	// fail.
+	XFail Marker
+	// Requirements declared with the `requires` directive. The test is
+	// skipped if any of them is not met.
+	Requires []string
+	// Shell used to run the commands of this test, with its options.
+	// Declared with the `shell` directive or a shebang on the first line.
+	Shell []string
+	// Fixture directories copied over the global working dir, in order.
+	// Declared with the `fixtures` directive, or found next to the test
+	// file, e.g. `foo.fixtures/` for `foo.tesh`.
+	Fixtures []string
+	// Steps building a git repository in the working dir, after installing
+	// the fixtures. Declared with the `git` directive.
+	Git []GitStep
+	// Stubs shadowing real programs for all the commands of the test.
+	// Declared with the `stub` directive.
+	Stubs []Stub
+	// Routes of the stub HTTP servers started for the test. Declared with
+	// the `http` directive.
+	HTTP []HTTPRoute
+	// Keys ignored when comparing the structured outputs of all the
+	// commands, declared with the `ignore-keys` directive.
+	IgnoreKeys []string
+}
+
+// HasTag returns whether the test was tagged with any of the given tags.
+func (n TestNode) HasTag(tags ...string) bool {
+	for _, tag := range tags {
+		for _, t := range n.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (n TestNode) IsEmpty() bool {
@@ -72,6 +116,9 @@ func prefixLines(content string, prefix string) string {
 
 type CommentNode struct {
 	Content string
+	// Whether the first line is a shebang, e.g. `#!/bin/bash`, only on the
+	// first line of a test.
+	Shebang bool
 }
 
 func (n CommentNode) IsEmpty() bool {
@@ -82,7 +129,15 @@ func (n CommentNode) Dump() string {
 	if n.IsEmpty() {
 		return ""
 	}
-	return prefixLines(n.Content, "# ") + "\n"
+	out := ""
+	for i, line := range strings.Split(n.Content, "\n") {
+		if i == 0 && n.Shebang {
+			out += "#" + line + "\n"
+		} else {
+			out += "# " + line + "\n"
+		}
+	}
+	return out
 }
 
 type CommandNode struct {
@@ -92,6 +147,40 @@ type CommandNode struct {
 	Stdin    DataNode
 	Stdout   DataNode
 	Stderr   DataNode
+	// Combined holds the expected lines of stdout and stderr in the order
+	// they were written, each line prefixed with its origin: `&>` or `&2>`.
+	// It is used instead of Stdout and Stderr.
+	Combined DataNode
+	// Expected content of files written by the command, declared with
+	// `[path]>` lines.
+	Files []FileOutput
+	// Skip is set with the `skip` directive, to skip only this command.
+	Skip Marker
+	// Requirements declared with the `requires` directive. The test is
+	// skipped when reaching this command, if any of them is not met.
+	Requires []string
+	// Stubs declared with the `stub` directive, shadowing real programs
+	// for this command and the following ones.
+	Stubs []Stub
+	// Name of the background process started by the command, when written
+	// `&name$ cmd`. Its output and exit code are asserted when stopping it
+	// with `tesh-stop` or `tesh-wait`.
+	Background string
+	// Condition to wait for before running the next commands, declared with
+	// the `ready` directive above a background command.
+	Ready ReadyCondition
+	// Signals sent to the command while it is running, in order. Declared
+	// with the `signal` directive.
+	Signals []SignalTrigger
+	// Retries the command until its assertions pass, declared with the
+	// `retry` directive.
+	Retry RetryPolicy
+	// Tells when the stdin of the command is closed, declared with the
+	// `stdin` directive.
+	StdinMode StdinMode
+	// Keys ignored when comparing structured outputs, declared with the
+	// `ignore-keys` directive.
+	IgnoreKeys []string
 }
 
 func (n CommandNode) IsEmpty() bool {
@@ -108,39 +197,111 @@ func (n CommandNode) Dump() string {
 		out += n.Comment.Dump()
 	}
 
-	if n.ExitCode != 0 {
+	if n.Background != "" {
+		out += "&" + n.Background
+	} else if n.ExitCode != 0 {
 		out += fmt.Sprint(n.ExitCode)
 	}
 	out += "$ " + n.Cmd + "\n"
 	if !n.Stdin.IsEmpty() {
-		out += prefixLines(n.Stdin.Content, "<") + "\n"
+		out += n.Stdin.dumpLines("<") + "\n"
 	}
 	if !n.Stdout.IsEmpty() {
-		out += prefixLines(n.Stdout.Content, ">") + "\n"
+		out += n.Stdout.dumpLines(">") + "\n"
 	}
 	if !n.Stderr.IsEmpty() {
-		out += prefixLines(n.Stderr.Content, "2>") + "\n"
+		out += n.Stderr.dumpLines("2>") + "\n"
+	}
+	if !n.Combined.IsEmpty() {
+		// The lines are already prefixed.
+		out += n.Combined.Content
+	}
+	for _, file := range n.Files {
+		if !file.Data.IsEmpty() {
+			out += file.Data.dumpLines("["+file.Path+"]>") + "\n"
+		}
 	}
 
 	return out
 }
 
+// Marker is set by a flag directive with an optional reason, e.g.
+// `# skip: flaky on CI`.
+type Marker struct {
+	Set    bool
+	Reason string
+}
+
 type DataNode struct {
 	Content string
+	// Encoding of the data lines, when the content is binary.
+	Encoding Encoding
+	// Format of the content, when it is compared structurally.
+	Format Format
+	// Path to a golden file holding the content, relative to the test file.
+	// Written as a single data line, e.g. `>@golden/list.txt`.
+	Golden string
 }
 
 func (n DataNode) IsEmpty() bool {
-	return n.Content == ""
+	return n.Content == "" && n.Golden == ""
 }
 
 func (n DataNode) Dump() string {
 	return n.Content
 }
 
+// Append adds the data of the given line to the node. The line must be
+// decoded beforehand.
 func (n DataNode) Append(line DataLine) DataNode {
 	return DataNode{
-		Content: n.Content + line.Content,
+		Content:  n.Content + line.Content,
+		Encoding: line.Encoding,
+		Format:   line.Format,
+		Golden:   line.Golden,
+	}
+}
+
+// dumpLines returns the data lines of the node, with the given stream
+// prefix, e.g. `2>`.
+func (n DataNode) dumpLines(prefix string) string {
+	if n.Format != NoFormat {
+		// The format is written before the stream symbol, e.g. `2json>`.
+		prefix = prefix[:len(prefix)-1] + string(n.Format) + prefix[len(prefix)-1:]
+	}
+	if n.Golden != "" {
+		return prefix + "@" + n.Golden
 	}
+	if n.Encoding == NoEncoding {
+		if strings.HasSuffix(prefix, ">") && isGoldenLine(n.Content) {
+			// Escapes a line which would be read as a golden file.
+			return prefix + "\\" + strings.TrimSuffix(n.Content, "\n")
+		}
+		return prefixLines(n.Content, prefix)
+	}
+	// The encoding is written before the stream symbol, e.g. `2hex>`.
+	symbol := prefix[len(prefix)-1:]
+	prefix = prefix[:len(prefix)-1] + string(n.Encoding) + symbol + " "
+	return prefix + strings.Join(n.Encoding.encode(n.Content), "\n"+prefix)
+}
+
+// file returns the expected output of the file at the given path, adding it
+// if needed.
+func (n *CommandNode) file(path string) *FileOutput {
+	for i := range n.Files {
+		if n.Files[i].Path == path {
+			return &n.Files[i]
+		}
+	}
+	n.Files = append(n.Files, FileOutput{Path: path})
+	return &n.Files[len(n.Files)-1]
+}
+
+// FileOutput is the expected content of a file after running a command,
+// relative to the working dir.
+type FileOutput struct {
+	Path string
+	Data DataNode
 }
 
 type SpacerNode struct {
@@ -173,12 +334,15 @@ func (s BlankLine) Merge(other Line) (Line, bool) {
 
 type CommentLine struct {
 	Content string
+	// Whether the first line is written `#!`, without a space.
+	Shebang bool
 }
 
 func (s CommentLine) Merge(other Line) (Line, bool) {
 	if other, ok := other.(CommentLine); ok {
 		return CommentLine{
 			Content: s.Content + "\n" + other.Content,
+			Shebang: s.Shebang,
 		}, true
 	} else {
 		return s, false
@@ -188,6 +352,8 @@ func (s CommentLine) Merge(other Line) (Line, bool) {
 type CommandLine struct {
 	Cmd      string
 	ExitCode int
+	// Name of the background process started by the command, if any.
+	Background string
 }
 
 func (s CommandLine) Merge(other Line) (Line, bool) {
@@ -200,6 +366,10 @@ const (
 	Stdin  FD = 0
 	Stdout FD = 1
 	Stderr FD = 2
+	// Combined is the output of both stdout and stderr.
+	Combined FD = -1
+	// File is the content of a file written by a command.
+	File FD = -2
 )
 
 func (fd FD) String() string {
@@ -210,6 +380,10 @@ func (fd FD) String() string {
 		return "stdout"
 	case Stderr:
 		return "stderr"
+	case Combined:
+		return "combined output"
+	case File:
+		return "file"
 	default:
 		return fmt.Sprintf("%d", fd)
 	}
@@ -218,13 +392,24 @@ func (fd FD) String() string {
 type DataLine struct {
 	FD      FD
 	Content string
+	// Encoding of the content, e.g. `hex>`.
+	Encoding Encoding
+	// Format of the content, e.g. `json>`.
+	Format Format
+	// Path of the file holding the data, when the FD is File.
+	Path string
+	// Path to the golden file holding the data, instead of the content.
+	Golden string
 }
 
 func (s DataLine) Merge(other Line) (Line, bool) {
-	if other, ok := other.(DataLine); ok && s.FD == other.FD {
+	if other, ok := other.(DataLine); ok && s.FD == other.FD && s.Encoding == other.Encoding && s.Format == other.Format && s.Path == other.Path {
 		return DataLine{
-			FD:      s.FD,
-			Content: s.Content + other.Content,
+			FD:       s.FD,
+			Content:  s.Content + other.Content,
+			Encoding: s.Encoding,
+			Format:   s.Format,
+			Path:     s.Path,
 		}, true
 	} else {
 		return s, false
@@ -0,0 +1,346 @@
+package tesh
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	executil "github.com/mickael-menu/tesh/pkg/internal/util/exec"
+)
+
+// ReadyCondition tells when a background process is ready, declared with
+// the `ready` directive, e.g. `# ready: port 8080 within 5s`.
+type ReadyCondition struct {
+	// Either "line", "port" or "file". Empty when the process is ready as
+	// soon as it is started.
+	Kind string
+	// Regular expression matching a line of the output, or path to a file
+	// relative to the working dir.
+	Pattern string
+	Port    int
+	// Maximum time to wait for the process to be ready.
+	Timeout time.Duration
+}
+
+const (
+	defaultReadyTimeout = 10 * time.Second
+	defaultStopTimeout  = 10 * time.Second
+)
+
+// parseReadyCondition parses the arguments of a `ready` directive:
+// `line <regex>`, `port <port>` or `file <path>`, optionally followed by
+// `within <duration>`. A trailing `within` which is not followed by a
+// duration is part of the value, e.g. a regex.
+func parseReadyCondition(args string) (ReadyCondition, error) {
+	ready := ReadyCondition{Timeout: defaultReadyTimeout}
+
+	args = strings.TrimSpace(args)
+	if i := strings.LastIndex(args, " within "); i >= 0 {
+		timeout, err := time.ParseDuration(strings.TrimSpace(args[i+len(" within "):]))
+		if err == nil {
+			ready.Timeout = timeout
+			args = strings.TrimSpace(args[:i])
+		}
+	}
+
+	parts := strings.SplitN(args, " ", 2)
+	if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+		return ready, fmt.Errorf("expected `line <regex>`, `port <port>` or `file <path>`")
+	}
+	ready.Kind = parts[0]
+	value := strings.TrimSpace(parts[1])
+
+	switch ready.Kind {
+	case "line":
+		if _, err := regexp.Compile(value); err != nil {
+			return ready, err
+		}
+		ready.Pattern = value
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return ready, fmt.Errorf("invalid port: `%s`", value)
+		}
+		ready.Port = port
+	case "file":
+		ready.Pattern = value
+	default:
+		return ready, fmt.Errorf("unknown condition: `%s`", ready.Kind)
+	}
+	return ready, nil
+}
+
+// backgroundProcs are the processes started in the background by the
+// commands of a test, by name.
+type backgroundProcs struct {
+	procs map[string]*backgroundProc
+}
+
+func newBackgroundProcs() *backgroundProcs {
+	return &backgroundProcs{procs: map[string]*backgroundProc{}}
+}
+
+type backgroundProc struct {
+	name     string
+	cmd      *exec.Cmd
+	stdout   syncBuffer
+	stderr   syncBuffer
+	combined combinedOutput
+	// Closed when the process exited, after setting err.
+	done chan struct{}
+	err  error
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, to read the output
+// of a process while it is running.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// runBackgroundCmd starts the command in the background, and waits until it
+// is ready.
+func runBackgroundCmd(sourceNode *CommandNode, config RunConfig) error {
+	node, err := expandNode(*sourceNode, config.Context())
+	if err != nil {
+		return err
+	}
+	if proc, ok := config.background.procs[node.Background]; ok && !proc.exited() {
+		return fmt.Errorf("background process %s is already running", node.Background)
+	}
+
+	proc := &backgroundProc{
+		name: node.Background,
+		cmd:  executil.ShellCommand(config.Shell, node.Cmd),
+		done: make(chan struct{}),
+	}
+	proc.cmd.Dir = config.WorkingDir
+	stdin, err := setStdin(proc.cmd, node.Stdin.Content, node.StdinMode)
+	if err != nil {
+		return err
+	}
+	proc.cmd.Env = commandEnv(config)
+	if err := writeCmdEnv(proc.cmd.Env, config); err != nil {
+		if stdin != nil {
+			stdin.close()
+		}
+		return err
+	}
+	// The combined output is always recorded, as it is asserted later with
+	// tesh-stop or tesh-wait.
+	capture, err := captureCombined(proc.cmd, &proc.stdout, &proc.stderr, &proc.combined)
+	if err != nil {
+		if stdin != nil {
+			stdin.close()
+		}
+		return err
+	}
+	// The process gets its own process group, to stop its children too.
+	setProcessGroup(proc.cmd)
+
+	if err := proc.cmd.Start(); err != nil {
+		if stdin != nil {
+			stdin.close()
+		}
+		capture.wait()
+		return err
+	}
+	config.background.procs[proc.name] = proc
+	go func() {
+		proc.err = proc.cmd.Wait()
+		capture.wait()
+		close(proc.done)
+	}()
+	if stdin != nil {
+		stdin.start(proc.done)
+	}
+	if len(node.Signals) > 0 {
+		go sendSignals(proc.cmd, node.Signals, &proc.stdout, &proc.stderr, proc.done)
+	}
+
+	return proc.waitReady(node.Ready, config.WorkingDir)
+}
+
+// waitReady polls the ready condition until it is met, or the timeout
+// expires.
+func (p *backgroundProc) waitReady(ready ReadyCondition, workingDir string) error {
+	if ready.Kind == "" {
+		return nil
+	}
+
+	var lineRegex *regexp.Regexp
+	if ready.Kind == "line" {
+		lineRegex = regexp.MustCompile("(?m)" + ready.Pattern)
+	}
+	isReady := func() bool {
+		switch ready.Kind {
+		case "line":
+			return lineRegex.MatchString(p.stdout.String()) || lineRegex.MatchString(p.stderr.String())
+		case "port":
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(ready.Port)), 100*time.Millisecond)
+			if err == nil {
+				conn.Close()
+			}
+			return err == nil
+		case "file":
+			_, err := os.Stat(filepath.Join(workingDir, ready.Pattern))
+			return err == nil
+		default:
+			panic(fmt.Sprintf("unknown ready condition: %s", ready.Kind))
+		}
+	}
+
+	timeout := time.After(ready.Timeout)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if isReady() {
+			return nil
+		}
+		select {
+		case <-p.done:
+			if isReady() {
+				return nil
+			}
+			return p.notReadyError(fmt.Sprintf("exited with code %d before being ready", exitStatus(p.err)))
+		case <-timeout:
+			return p.notReadyError(fmt.Sprintf("not ready after %s", ready.Timeout))
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *backgroundProc) notReadyError(reason string) error {
+	msg := fmt.Sprintf("background process %s %s", p.name, reason)
+	if output := strings.TrimSpace(p.stdout.String() + p.stderr.String()); output != "" {
+		msg += ":\n" + output
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func (p *backgroundProc) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop terminates the process and its children with SIGTERM, or kills them
+// if they are still running after the timeout.
+func (p *backgroundProc) stop(timeout time.Duration) {
+	if p.exited() {
+		return
+	}
+	signalProcessGroup(p.cmd, syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		signalProcessGroup(p.cmd, syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+func (p *backgroundProc) result() cmdResult {
+	return cmdResult{
+		Stdout:   p.stdout.String(),
+		Stderr:   p.stderr.String(),
+		Combined: p.combined.String(),
+		ExitCode: exitStatus(p.err),
+	}
+}
+
+// stopAll stops the processes still running, at the end of a test.
+func (b *backgroundProcs) stopAll() {
+	for _, proc := range b.procs {
+		proc.stop(defaultStopTimeout)
+	}
+}
+
+func (b *backgroundProcs) get(args []string, usage string) (*backgroundProc, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: %s", usage)
+	}
+	proc, ok := b.procs[args[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown background process: %s", args[0])
+	}
+	return proc, nil
+}
+
+// runStopCmd implements the `tesh-stop <name>` builtin, stopping a
+// background process. It prints the output of the process and exits with
+// its exit code.
+func runStopCmd(args []string, stdin string, config RunConfig) (cmdResult, error) {
+	proc, err := config.background.get(args, "tesh-stop <name>")
+	if err != nil {
+		return cmdResult{}, err
+	}
+	proc.stop(defaultStopTimeout)
+	return proc.result(), nil
+}
+
+// runWaitCmd implements the `tesh-wait <name> [<timeout>]` builtin, waiting
+// for a background process to exit. It prints the output of the process and
+// exits with its exit code.
+func runWaitCmd(args []string, stdin string, config RunConfig) (cmdResult, error) {
+	timeout := defaultStopTimeout
+	if len(args) == 2 {
+		var err error
+		timeout, err = time.ParseDuration(args[1])
+		if err != nil {
+			return cmdResult{}, fmt.Errorf("invalid timeout: %w", err)
+		}
+		args = args[:1]
+	}
+	proc, err := config.background.get(args, "tesh-wait <name> [<timeout>]")
+	if err != nil {
+		return cmdResult{}, err
+	}
+
+	select {
+	case <-proc.done:
+		return proc.result(), nil
+	case <-time.After(timeout):
+		return cmdResult{}, fmt.Errorf("background process %s still running after %s", proc.name, timeout)
+	}
+}
+
+// exitStatus returns the exit code of a process from the error returned
+// when waiting for it. A process terminated by a signal exits with 128 plus
+// the signal number, like in shells.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
@@ -0,0 +1,67 @@
+package tesh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mickael-menu/tesh/pkg/internal/handlebars"
+)
+
+// builtinCmd is a pseudo-command run by tesh itself instead of the shell,
+// to inspect or control the state of a test. Builtins are prefixed with
+// `tesh-` to avoid conflicts with real programs.
+type builtinCmd func(args []string, stdin string, config RunConfig) (cmdResult, error)
+
+var builtinCmds = map[string]builtinCmd{
+	"tesh-calls":    runCallsCmd,
+	"tesh-requests": runRequestsCmd,
+	"tesh-stop":     runStopCmd,
+	"tesh-wait":     runWaitCmd,
+}
+
+// isBuiltinCmd returns whether the given command line runs a builtin.
+func isBuiltinCmd(cmd string) bool {
+	_, ok := builtinCmds[builtinName(cmd)]
+	return ok
+}
+
+// builtinName returns the first word of the command line, ending at a
+// whitespace or a shell metacharacter.
+func builtinName(cmd string) string {
+	cmd = strings.TrimSpace(cmd)
+	if i := strings.IndexAny(cmd, " \t"+shellMetacharacters); i >= 0 {
+		return cmd[:i]
+	}
+	return cmd
+}
+
+// shellMetacharacters are not supported in the command line of a builtin.
+const shellMetacharacters = "|&;<>$`"
+
+func runBuiltinCmd(sourceNode *CommandNode, config RunConfig, hasChanges *bool) error {
+	node, err := expandNode(*sourceNode, config.Context())
+	if err != nil {
+		return err
+	}
+
+	// Builtins are not run by the shell, so pipes, redirections or variables
+	// would be given as arguments.
+	if strings.ContainsAny(node.Cmd, shellMetacharacters) {
+		return fmt.Errorf("%s: unexpected shell syntax in `%s`, builtin commands are not run by the shell", builtinName(node.Cmd), node.Cmd)
+	}
+	words, err := splitWords(node.Cmd)
+	if err != nil {
+		return err
+	}
+	result, err := builtinCmds[words[0]](words[1:], handlebars.StripDelays(node.Stdin.Content), config)
+	if err != nil {
+		return fmt.Errorf("%s: %w", words[0], err)
+	}
+	if result.Combined == "" {
+		result.Combined = renderCombinedOutput([]outputChunk{
+			{FD: Stdout, Data: result.Stdout},
+			{FD: Stderr, Data: result.Stderr},
+		})
+	}
+	return assertResult(sourceNode, node, result, config, hasChanges)
+}
@@ -0,0 +1,79 @@
+package tesh
+
+import (
+	"strings"
+	"sync"
+)
+
+// combinedOutput records the output of a command written on both stdout and
+// stderr, in the order of the writes. See captureCombined.
+type combinedOutput struct {
+	mutex  sync.Mutex
+	chunks []outputChunk
+}
+
+type outputChunk struct {
+	FD   FD
+	Data string
+}
+
+// record appends the data written by the command on the given stream.
+func (o *combinedOutput) record(fd FD, data []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.chunks = append(o.chunks, outputChunk{FD: fd, Data: string(data)})
+}
+
+func (o *combinedOutput) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return renderCombinedOutput(o.chunks)
+}
+
+// combinedPrefixes are the prefixes of the lines of a combined output block,
+// telling the origin of each line.
+var combinedPrefixes = map[FD]string{
+	Stdout: "&>",
+	Stderr: "&2>",
+}
+
+// renderCombinedOutput returns the lines of a combined output block for the
+// given chunks, e.g.
+//
+//	&>result 1
+//	&2>warning
+//	&>result 2
+//
+// A line interrupted by the output of the other stream ends with a `\`,
+// like a line without a final newline.
+func renderCombinedOutput(chunks []outputChunk) string {
+	out := ""
+	line := ""
+	lineFD := Stdout
+	isOpen := false
+	for _, chunk := range chunks {
+		data := chunk.Data
+		for data != "" {
+			if isOpen && lineFD != chunk.FD {
+				out += combinedPrefixes[lineFD] + line + "\\\n"
+				line = ""
+				isOpen = false
+			}
+			i := strings.IndexByte(data, '\n')
+			if i < 0 {
+				line += data
+				lineFD = chunk.FD
+				isOpen = true
+				break
+			}
+			out += combinedPrefixes[chunk.FD] + line + data[:i] + "\n"
+			line = ""
+			isOpen = false
+			data = data[i+1:]
+		}
+	}
+	if isOpen {
+		out += combinedPrefixes[lineFD] + line + "\\\n"
+	}
+	return out
+}
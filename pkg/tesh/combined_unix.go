@@ -0,0 +1,138 @@
+//go:build !windows
+// +build !windows
+
+package tesh
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// maxWriteSize is the size of the largest write of a command supported by
+// the capture of its combined output.
+const maxWriteSize = 256 * 1024
+
+// combinedCapture gives the command two unix datagram sockets as stdout and
+// stderr, sending to the same receiving socket. Each write of the command
+// is a datagram tagged with the address of its sender, so the writes on
+// both streams are received in order, with their origin.
+type combinedCapture struct {
+	dir      string
+	receiver *net.UnixConn
+	senders  []*os.File
+	// Closed when the reader stopped.
+	done chan struct{}
+}
+
+// captureCombined sets the outputs of the command, to write them to stdout
+// and stderr and to record them in combined. wait must be called after the
+// command exited or failed to start.
+func captureCombined(cmd *exec.Cmd, stdout, stderr io.Writer, combined *combinedOutput) (*combinedCapture, error) {
+	dir, err := ioutil.TempDir("", "tesh-output")
+	if err != nil {
+		return nil, err
+	}
+	c := &combinedCapture{dir: dir, done: make(chan struct{})}
+	c.receiver, err = net.ListenUnixgram("unixgram", c.addr("r"))
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	// Some platforms drop the datagrams which don't fit in the buffer of the
+	// receiver, instead of blocking the sender.
+	_ = c.receiver.SetReadBuffer(4 * maxWriteSize)
+	for _, name := range []string{"1", "2"} {
+		sender, err := c.sender(name)
+		if err != nil {
+			c.receiver.Close()
+			c.close()
+			return nil, err
+		}
+		c.senders = append(c.senders, sender)
+	}
+	cmd.Stdout = c.senders[0]
+	cmd.Stderr = c.senders[1]
+
+	go c.read(stdout, stderr, combined)
+	return c, nil
+}
+
+func (c *combinedCapture) addr(name string) *net.UnixAddr {
+	return &net.UnixAddr{Name: filepath.Join(c.dir, name), Net: "unixgram"}
+}
+
+// sender returns a socket bound to the given name and sending to the
+// receiver, to be used as an output of the command.
+func (c *combinedCapture) sender(name string) (*os.File, error) {
+	conn, err := net.DialUnix("unixgram", c.addr(name), c.addr("r"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteBuffer(maxWriteSize); err != nil {
+		return nil, err
+	}
+	file, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+	// The command writes in blocking mode, like to a pipe.
+	if err := syscall.SetNonblock(int(file.Fd()), false); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (c *combinedCapture) read(stdout, stderr io.Writer, combined *combinedOutput) {
+	defer close(c.done)
+	buf := make([]byte, 4*maxWriteSize)
+	for {
+		n, addr, err := c.receiver.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		if addr == nil {
+			continue
+		}
+		switch filepath.Base(addr.Name) {
+		case "1":
+			stdout.Write(buf[:n])
+			combined.record(Stdout, buf[:n])
+		case "2":
+			stderr.Write(buf[:n])
+			combined.record(Stderr, buf[:n])
+		default:
+			// Sent by wait, after every write of the command.
+			return
+		}
+	}
+}
+
+// wait reads the remaining output of the command, and releases the sockets.
+// The writes of any child process still running are not recorded.
+func (c *combinedCapture) wait() {
+	conn, err := net.DialUnix("unixgram", c.addr("end"), c.addr("r"))
+	if err == nil {
+		_, err = conn.Write([]byte{0})
+		conn.Close()
+	}
+	if err == nil {
+		<-c.done
+	}
+	c.receiver.Close()
+	<-c.done
+	c.close()
+}
+
+func (c *combinedCapture) close() {
+	for _, sender := range c.senders {
+		sender.Close()
+	}
+	os.RemoveAll(c.dir)
+}
@@ -0,0 +1,31 @@
+package tesh
+
+import (
+	"io"
+	"os/exec"
+)
+
+// Unix datagram sockets are not supported on Windows, so stdout and stderr
+// are read from two pipes. The combined output is recorded in the order of
+// the reads, which may differ from the order of the writes when they are
+// close in time.
+
+type combinedCapture struct{}
+
+func captureCombined(cmd *exec.Cmd, stdout, stderr io.Writer, combined *combinedOutput) (*combinedCapture, error) {
+	cmd.Stdout = io.MultiWriter(stdout, &combinedWriter{fd: Stdout, output: combined})
+	cmd.Stderr = io.MultiWriter(stderr, &combinedWriter{fd: Stderr, output: combined})
+	return &combinedCapture{}, nil
+}
+
+func (c *combinedCapture) wait() {}
+
+type combinedWriter struct {
+	fd     FD
+	output *combinedOutput
+}
+
+func (w *combinedWriter) Write(p []byte) (int, error) {
+	w.output.record(w.fd, p)
+	return len(p), nil
+}
@@ -0,0 +1,256 @@
+package tesh
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Directive is a special comment line configuring how a test or a command
+// is run, e.g. `# tags: slow, network`.
+//
+// Directives found in a comment directly above a command apply to this
+// command, otherwise they apply to the whole test. Directives which only
+// make sense for a test always apply to the whole test.
+type Directive struct {
+	Name string
+	Args string
+}
+
+type directiveScope int
+
+const (
+	testScope directiveScope = iota
+	commandScope
+)
+
+// directiveScopes lists the known directives with the narrowest node they
+// can be applied to.
+var directiveScopes = map[string]directiveScope{
+	"tags":        testScope,
+	"skip":        commandScope,
+	"only":        testScope,
+	"xfail":       testScope,
+	"requires":    commandScope,
+	"shell":       testScope,
+	"fixtures":    testScope,
+	"git":         testScope,
+	"stub":        commandScope,
+	"http":        testScope,
+	"ready":       commandScope,
+	"signal":      commandScope,
+	"retry":       commandScope,
+	"stdin":       commandScope,
+	"ignore-keys": commandScope,
+}
+
+var directiveRegex = regexp.MustCompile(`^([a-z][a-z-]*)(?::(.*))?$`)
+
+// parseDirectives extracts the directives found in the given comment
+// content. Lines which are not directives are ignored.
+func parseDirectives(comment string) []Directive {
+	directives := []Directive{}
+	for _, line := range strings.Split(comment, "\n") {
+		matches := directiveRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil {
+			continue
+		}
+		if _, ok := directiveScopes[matches[1]]; !ok {
+			continue
+		}
+		directives = append(directives, Directive{
+			Name: matches[1],
+			Args: strings.TrimSpace(matches[2]),
+		})
+	}
+	return directives
+}
+
+// applyDirectives configures the test, or the command if not nil, with the
+// directives found in the given comment.
+func applyDirectives(comment CommentNode, test *TestNode, cmd *CommandNode) error {
+	for _, directive := range parseDirectives(comment.Content) {
+		var err error
+		if cmd != nil && directiveScopes[directive.Name] == commandScope {
+			err = applyCommandDirective(directive, cmd)
+		} else {
+			err = applyTestDirective(directive, test)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid `%s` directive: %w", directive.Name, err)
+		}
+	}
+	return nil
+}
+
+func applyTestDirective(directive Directive, test *TestNode) error {
+	switch directive.Name {
+	case "tags":
+		tags := splitList(directive.Args)
+		if len(tags) == 0 {
+			return fmt.Errorf("expected at least one tag")
+		}
+		test.Tags = append(test.Tags, tags...)
+	case "skip":
+		test.Skip = Marker{Set: true, Reason: directive.Args}
+	case "only":
+		if directive.Args != "" {
+			return fmt.Errorf("unexpected arguments: `%s`", directive.Args)
+		}
+		test.Only = true
+	case "xfail":
+		test.XFail = Marker{Set: true, Reason: directive.Args}
+	case "requires":
+		requirements, err := parseRequirements(directive.Args)
+		if err != nil {
+			return err
+		}
+		test.Requires = append(test.Requires, requirements...)
+	case "fixtures":
+		fixtures := splitList(directive.Args)
+		if len(fixtures) == 0 {
+			return fmt.Errorf("expected at least one fixture")
+		}
+		test.Fixtures = append(test.Fixtures, fixtures...)
+	case "git":
+		step, err := parseGitStep(directive.Args)
+		if err != nil {
+			return err
+		}
+		test.Git = append(test.Git, step)
+	case "stub":
+		stub, err := parseStub(directive.Args)
+		if err != nil {
+			return err
+		}
+		test.Stubs = append(test.Stubs, stub)
+	case "http":
+		route, err := parseHTTPRoute(directive.Args)
+		if err != nil {
+			return err
+		}
+		test.HTTP = append(test.HTTP, route)
+	case "ready":
+		return fmt.Errorf("expected a background command below")
+	case "signal", "retry", "stdin":
+		return fmt.Errorf("expected a command below")
+	case "ignore-keys":
+		keys := splitList(directive.Args)
+		if len(keys) == 0 {
+			return fmt.Errorf("expected at least one key")
+		}
+		test.IgnoreKeys = append(test.IgnoreKeys, keys...)
+	case "shell":
+		test.Shell = strings.Fields(directive.Args)
+		if len(test.Shell) == 0 {
+			return fmt.Errorf("expected a shell")
+		}
+	default:
+		panic(fmt.Sprintf("unknown test directive: %s", directive.Name))
+	}
+	return nil
+}
+
+func applyCommandDirective(directive Directive, cmd *CommandNode) error {
+	switch directive.Name {
+	case "skip":
+		cmd.Skip = Marker{Set: true, Reason: directive.Args}
+	case "requires":
+		requirements, err := parseRequirements(directive.Args)
+		if err != nil {
+			return err
+		}
+		cmd.Requires = append(cmd.Requires, requirements...)
+	case "stub":
+		stub, err := parseStub(directive.Args)
+		if err != nil {
+			return err
+		}
+		cmd.Stubs = append(cmd.Stubs, stub)
+	case "ready":
+		if cmd.Background == "" {
+			return fmt.Errorf("expected a background command below, e.g. `&server$ cmd`")
+		}
+		ready, err := parseReadyCondition(directive.Args)
+		if err != nil {
+			return err
+		}
+		cmd.Ready = ready
+	case "signal":
+		trigger, err := parseSignalTrigger(directive.Args)
+		if err != nil {
+			return err
+		}
+		cmd.Signals = append(cmd.Signals, trigger)
+	case "retry":
+		if cmd.Background != "" {
+			return fmt.Errorf("a background command can't be retried")
+		}
+		policy, err := parseRetryPolicy(directive.Args)
+		if err != nil {
+			return err
+		}
+		cmd.Retry = policy
+	case "stdin":
+		mode, err := parseStdinMode(directive.Args)
+		if err != nil {
+			return err
+		}
+		cmd.StdinMode = mode
+	case "ignore-keys":
+		keys := splitList(directive.Args)
+		if len(keys) == 0 {
+			return fmt.Errorf("expected at least one key")
+		}
+		cmd.IgnoreKeys = append(cmd.IgnoreKeys, keys...)
+	default:
+		panic(fmt.Sprintf("unknown command directive: %s", directive.Name))
+	}
+	return nil
+}
+
+// splitList splits a list of items separated by commas or whitespaces.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// splitWords splits the given string on whitespaces, unquoting the words
+// written as Go double-quoted strings.
+func splitWords(s string) ([]string, error) {
+	words := []string{}
+	s = strings.TrimSpace(s)
+	for s != "" {
+		var word string
+		if s[0] == '"' {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unclosed quoted string: `%s`", s)
+			}
+			var err error
+			word, err = strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string: `%s`", s[:end+1])
+			}
+			s = s[end+1:]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			word = s[:end]
+			s = s[end:]
+		}
+		words = append(words, word)
+		s = strings.TrimLeft(s, " \t")
+	}
+	return words, nil
+}
@@ -0,0 +1,106 @@
+package tesh
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Encoding of a data block holding binary data. It is written before the
+// stream symbol of the data lines, e.g. `hex> 00 ff` or `2base64> AP8=`.
+type Encoding string
+
+const (
+	NoEncoding     Encoding = ""
+	HexEncoding    Encoding = "hex"
+	Base64Encoding Encoding = "base64"
+)
+
+var encodings = map[string]Encoding{
+	"hex":    HexEncoding,
+	"base64": Base64Encoding,
+}
+
+const (
+	// Number of bytes per line of a hex block.
+	hexLineBytes = 16
+	// Number of characters per line of a base64 block.
+	base64LineLength = 76
+)
+
+// decode returns the data of the given encoded content. Whitespaces are
+// ignored, so the encoded data can be split on several lines.
+func (e Encoding) decode(content string) (string, error) {
+	if e == NoEncoding {
+		return content, nil
+	}
+	content = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, content)
+
+	var data []byte
+	var err error
+	switch e {
+	case HexEncoding:
+		data, err = hex.DecodeString(content)
+	case Base64Encoding:
+		data, err = base64.StdEncoding.DecodeString(content)
+	default:
+		panic(fmt.Sprintf("unknown encoding: %s", e))
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid %s data: %w", e, err)
+	}
+	return string(data), nil
+}
+
+// encode returns the lines of the encoded data.
+func (e Encoding) encode(data string) []string {
+	lines := []string{}
+	switch e {
+	case HexEncoding:
+		for len(data) > 0 {
+			n := hexLineBytes
+			if len(data) < n {
+				n = len(data)
+			}
+			bytes := []string{}
+			for i := 0; i < n; i++ {
+				bytes = append(bytes, hex.EncodeToString([]byte{data[i]}))
+			}
+			lines = append(lines, strings.Join(bytes, " "))
+			data = data[n:]
+		}
+	case Base64Encoding:
+		encoded := base64.StdEncoding.EncodeToString([]byte(data))
+		for len(encoded) > base64LineLength {
+			lines = append(lines, encoded[:base64LineLength])
+			encoded = encoded[base64LineLength:]
+		}
+		lines = append(lines, encoded)
+	default:
+		panic(fmt.Sprintf("unknown encoding: %s", e))
+	}
+	return lines
+}
+
+// isText returns whether the given data can be written in a text block
+// without losing information. Carriage returns are only accepted when they
+// are not part of a CRLF line break, which would be read as a LF.
+func isText(data string) bool {
+	if !utf8.ValidString(data) || strings.Contains(data, "\r\n") {
+		return false
+	}
+	for _, r := range data {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package tesh
+
+import "regexp"
+
+// Filter selects the tests to run from a suite.
+type Filter struct {
+	// Only the tests with a name matching this regex are selected.
+	Run *regexp.Regexp
+	// Only the tests with at least one of these tags are selected.
+	Tags []string
+	// The tests with any of these tags are excluded.
+	SkipTags []string
+}
+
+// Match returns whether the given test is selected by the filter.
+func (f Filter) Match(test TestNode) bool {
+	if f.Run != nil && !f.Run.MatchString(test.Name) {
+		return false
+	}
+	if len(f.Tags) > 0 && !test.HasTag(f.Tags...) {
+		return false
+	}
+	if test.HasTag(f.SkipTags...) {
+		return false
+	}
+	return true
+}
+
+// Filter returns a copy of the suite containing only the tests selected by
+// the given filter.
+func (n TestSuiteNode) Filter(filter Filter) TestSuiteNode {
+	suite := TestSuiteNode{}
+	for _, test := range n.Tests {
+		if filter.Match(test) {
+			suite.Tests = append(suite.Tests, test)
+		}
+	}
+	return suite
+}
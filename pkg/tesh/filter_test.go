@@ -0,0 +1,35 @@
+package tesh
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/mickael-menu/tesh/pkg/internal/util/test/assert"
+)
+
+func TestFilterSuite(t *testing.T) {
+	suite := TestSuiteNode{Tests: []TestNode{
+		{Name: "list.tesh"},
+		{Name: "list-slow.tesh", Tags: []string{"slow"}},
+		{Name: "fetch.tesh", Tags: []string{"slow", "network"}},
+		{Name: "edit.tesh", Tags: []string{"editor"}},
+	}}
+
+	testFilterSuite(t, suite, Filter{}, []string{"list.tesh", "list-slow.tesh", "fetch.tesh", "edit.tesh"})
+	testFilterSuite(t, suite, Filter{Run: regexp.MustCompile(`^list`)}, []string{"list.tesh", "list-slow.tesh"})
+	testFilterSuite(t, suite, Filter{Tags: []string{"slow", "editor"}}, []string{"list-slow.tesh", "fetch.tesh", "edit.tesh"})
+	testFilterSuite(t, suite, Filter{SkipTags: []string{"network"}}, []string{"list.tesh", "list-slow.tesh", "edit.tesh"})
+	testFilterSuite(t, suite, Filter{
+		Run:      regexp.MustCompile(`^list`),
+		SkipTags: []string{"slow"},
+	}, []string{"list.tesh"})
+	testFilterSuite(t, suite, Filter{Tags: []string{"unknown"}}, []string{})
+}
+
+func testFilterSuite(t *testing.T, suite TestSuiteNode, filter Filter, expected []string) {
+	names := []string{}
+	for _, test := range suite.Filter(filter).Tests {
+		names = append(names, test.Name)
+	}
+	assert.Equal(t, names, expected)
+}
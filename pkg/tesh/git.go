@@ -0,0 +1,189 @@
+package tesh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mickael-menu/tesh/pkg/internal/util/errors"
+)
+
+// GitStep is a step building the git repository fixture of a test, declared
+// with the `git` directive, e.g. `# git: commit Initial commit`.
+type GitStep struct {
+	Op   string
+	Args []string
+}
+
+// gitStepArity lists the supported git steps with their minimum and maximum
+// number of arguments. A negative maximum means no limit.
+var gitStepArity = map[string][2]int{
+	"init":     {0, 1},
+	"file":     {1, 2},
+	"rm":       {1, -1},
+	"commit":   {1, -1},
+	"branch":   {1, 1},
+	"checkout": {1, 1},
+	"tag":      {1, -1},
+	"merge":    {1, -1},
+}
+
+// parseGitStep parses the arguments of a `git` directive. Arguments are
+// separated by whitespaces, and can be written as Go double-quoted strings
+// to contain spaces or escaped characters, e.g. `file a.txt "hello\n"`.
+func parseGitStep(args string) (GitStep, error) {
+	words, err := splitWords(args)
+	if err != nil {
+		return GitStep{}, err
+	}
+	if len(words) == 0 {
+		return GitStep{}, fmt.Errorf("expected a step")
+	}
+
+	step := GitStep{Op: words[0], Args: words[1:]}
+	arity, ok := gitStepArity[step.Op]
+	if !ok {
+		return step, fmt.Errorf("unknown step: `%s`", step.Op)
+	}
+	if len(step.Args) < arity[0] || (arity[1] >= 0 && len(step.Args) > arity[1]) {
+		return step, fmt.Errorf("wrong number of arguments for `%s`", step.Op)
+	}
+	return step, nil
+}
+
+// Identity of the commits created by the git fixtures, and by the commands
+// of the tests using them.
+const (
+	gitAuthorName  = "tesh"
+	gitAuthorEmail = "tesh@example.com"
+)
+
+// gitEpoch is the date of the first commit of the git fixtures. Each
+// following commit is dated one minute later, to keep the hashes stable.
+var gitEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// gitRepo builds a git repository fixture in a working dir.
+type gitRepo struct {
+	dir string
+	env []string
+	// Number of commits and tags created so far, used to date them.
+	tick int
+}
+
+// setupGitRepo initializes a git repository in the working dir of the
+// config and runs the given steps. It returns the environment to give to
+// the commands of the test, for their own commits to be deterministic too.
+func setupGitRepo(steps []GitStep, config RunConfig) ([]string, error) {
+	repo := &gitRepo{dir: config.WorkingDir, env: commandEnv(config)}
+	if len(steps) > 0 && steps[0].Op != "init" {
+		steps = append([]GitStep{{Op: "init"}}, steps...)
+	}
+	for _, step := range steps {
+		if err := repo.run(step); err != nil {
+			return nil, errors.Wrapf(err, "git %s", strings.Join(append([]string{step.Op}, step.Args...), " "))
+		}
+	}
+	repo.tick++
+	return repo.identityEnv(), nil
+}
+
+func (r *gitRepo) run(step GitStep) error {
+	switch step.Op {
+	case "init":
+		branch := "main"
+		if len(step.Args) > 0 {
+			branch = step.Args[0]
+		}
+		if err := r.git("init", "-q"); err != nil {
+			return err
+		}
+		return r.git("symbolic-ref", "HEAD", "refs/heads/"+branch)
+	case "file":
+		path := filepath.Join(r.dir, filepath.FromSlash(step.Args[0]))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		content := ""
+		if len(step.Args) > 1 {
+			content = step.Args[1]
+		}
+		return ioutil.WriteFile(path, []byte(content), 0644)
+	case "rm":
+		for _, path := range step.Args {
+			if err := os.RemoveAll(filepath.Join(r.dir, filepath.FromSlash(path))); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "commit":
+		if err := r.git("add", "-A"); err != nil {
+			return err
+		}
+		r.tick++
+		return r.git("commit", "-q", "--allow-empty", "-m", strings.Join(step.Args, " "))
+	case "branch":
+		return r.git("checkout", "-q", "-b", step.Args[0])
+	case "checkout":
+		return r.git("checkout", "-q", step.Args[0])
+	case "tag":
+		if len(step.Args) == 1 {
+			return r.git("tag", step.Args[0])
+		}
+		r.tick++
+		return r.git("tag", "-a", step.Args[0], "-m", strings.Join(step.Args[1:], " "))
+	case "merge":
+		r.tick++
+		args := []string{"merge", "-q", "--no-ff", step.Args[0]}
+		if len(step.Args) > 1 {
+			args = append(args, "-m", strings.Join(step.Args[1:], " "))
+		} else {
+			args = append(args, "--no-edit")
+		}
+		return r.git(args...)
+	default:
+		panic(fmt.Sprintf("unknown git step: %s", step.Op))
+	}
+}
+
+func (r *gitRepo) git(args ...string) error {
+	args = append([]string{
+		"-c", "commit.gpgsign=false",
+		"-c", "tag.gpgsign=false",
+		"-c", "core.autocrlf=false",
+	}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(append([]string{}, r.env...), r.identityEnv()...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// identityEnv returns the environment variables setting a deterministic
+// identity and date for the next commit, and ignoring the user's git
+// configuration.
+func (r *gitRepo) identityEnv() []string {
+	date := fmt.Sprintf("@%d +0000", gitEpoch.Add(time.Duration(r.tick)*time.Minute).Unix())
+	return []string{
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL=" + os.DevNull,
+		"GIT_AUTHOR_NAME=" + gitAuthorName,
+		"GIT_AUTHOR_EMAIL=" + gitAuthorEmail,
+		"GIT_AUTHOR_DATE=" + date,
+		"GIT_COMMITTER_NAME=" + gitAuthorName,
+		"GIT_COMMITTER_EMAIL=" + gitAuthorEmail,
+		"GIT_COMMITTER_DATE=" + date,
+	}
+}
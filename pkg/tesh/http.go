@@ -0,0 +1,353 @@
+package tesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HTTPRoute is a route of a stub HTTP server started for a test, declared
+// with the `http` directive, e.g.
+// `# http: api GET /notes 200 body "[]" header "Content-Type: application/json"`.
+type HTTPRoute struct {
+	// Name of the server, used to get its URL with `{{http.<name>}}`.
+	Server string
+	Method string
+	// Path of the route. When it contains a query string, the requests
+	// must have the same query string to match.
+	Path    string
+	Status  int
+	Body    string
+	Headers []string
+	// Path to a JSON file declaring routes for the server, used instead of
+	// the other fields.
+	File string
+}
+
+var httpMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+}
+
+// parseHTTPRoute parses the arguments of an `http` directive, either
+// `<server> <method> <path> [<status>] [body <body>] [header <header>]...`
+// or `<server> routes <file>`.
+func parseHTTPRoute(args string) (HTTPRoute, error) {
+	words, err := splitWords(args)
+	if err != nil {
+		return HTTPRoute{}, err
+	}
+	if len(words) < 3 {
+		return HTTPRoute{}, fmt.Errorf("expected a server name, a method and a path")
+	}
+
+	route := HTTPRoute{Server: words[0], Status: http.StatusOK}
+	if words[1] == "routes" {
+		if len(words) > 3 {
+			return route, fmt.Errorf("unexpected arguments: `%s`", strings.Join(words[3:], " "))
+		}
+		route.File = words[2]
+		return route, nil
+	}
+
+	route.Method = strings.ToUpper(words[1])
+	if !httpMethods[route.Method] {
+		return route, fmt.Errorf("unknown HTTP method: `%s`", words[1])
+	}
+	route.Path = words[2]
+	if !strings.HasPrefix(route.Path, "/") {
+		return route, fmt.Errorf("expected an absolute path: `%s`", route.Path)
+	}
+
+	options := words[3:]
+	if len(options) > 0 {
+		if status, err := strconv.Atoi(options[0]); err == nil {
+			if status < 100 || status > 999 {
+				return route, fmt.Errorf("invalid status code: `%s`", options[0])
+			}
+			route.Status = status
+			options = options[1:]
+		}
+	}
+	for i := 0; i < len(options); i += 2 {
+		if i+1 >= len(options) {
+			return route, fmt.Errorf("expected a value for `%s`", options[i])
+		}
+		value := options[i+1]
+		switch options[i] {
+		case "body":
+			route.Body = value
+		case "header":
+			if !strings.Contains(value, ":") {
+				return route, fmt.Errorf("invalid header: `%s`", value)
+			}
+			route.Headers = append(route.Headers, value)
+		default:
+			return route, fmt.Errorf("unknown route option: `%s`", options[i])
+		}
+	}
+	return route, nil
+}
+
+// jsonRoute is a route declared in a JSON routes file. The body is either a
+// string, or any JSON value sent as is.
+type jsonRoute struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Status  int               `json:"status"`
+	Body    json.RawMessage   `json:"body"`
+	Headers map[string]string `json:"headers"`
+}
+
+// readHTTPRoutesFile reads the routes declared in the given JSON file for
+// the server.
+func readHTTPRoutesFile(server string, path string) ([]HTTPRoute, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jsonRoutes []jsonRoute
+	if err := json.Unmarshal(content, &jsonRoutes); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	routes := []HTTPRoute{}
+	for _, r := range jsonRoutes {
+		route := HTTPRoute{
+			Server: server,
+			Method: strings.ToUpper(r.Method),
+			Path:   r.Path,
+			Status: r.Status,
+		}
+		if route.Method == "" {
+			route.Method = http.MethodGet
+		}
+		if route.Status == 0 {
+			route.Status = http.StatusOK
+		}
+		if len(r.Body) > 0 && r.Body[0] == '"' {
+			if err := json.Unmarshal(r.Body, &route.Body); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		} else {
+			route.Body = string(r.Body)
+		}
+		names := []string{}
+		for name := range r.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			route.Headers = append(route.Headers, name+": "+r.Headers[name])
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// httpServers are the stub HTTP servers of a test, by name.
+type httpServers struct {
+	servers  map[string]*httpServer
+	recorder *httpRecorder
+}
+
+// httpServer is a stub HTTP server listening on the loopback interface,
+// answering with the routes of a test and recording the requests received.
+type httpServer struct {
+	URL      string
+	routes   []HTTPRoute
+	server   *http.Server
+	recorder *httpRecorder
+}
+
+// httpRecorder records the requests received by all the servers of a test,
+// in order.
+type httpRecorder struct {
+	mutex    sync.Mutex
+	requests []httpRequest
+}
+
+type httpRequest struct {
+	Server string
+	Method string
+	URI    string
+	Header http.Header
+	Body   string
+}
+
+// startHTTPServers starts one server for each server name found in the
+// given routes.
+func startHTTPServers(routes []HTTPRoute) (*httpServers, error) {
+	s := &httpServers{
+		servers:  map[string]*httpServer{},
+		recorder: &httpRecorder{},
+	}
+
+	for _, route := range routes {
+		server, ok := s.servers[route.Server]
+		if !ok {
+			var err error
+			server, err = startHTTPServer(route.Server, s.recorder)
+			if err != nil {
+				s.stop()
+				return nil, err
+			}
+			s.servers[route.Server] = server
+		}
+
+		if route.File == "" {
+			server.routes = append(server.routes, route)
+			continue
+		}
+		fileRoutes, err := readHTTPRoutesFile(route.Server, route.File)
+		if err != nil {
+			s.stop()
+			return nil, err
+		}
+		server.routes = append(server.routes, fileRoutes...)
+	}
+	return s, nil
+}
+
+func startHTTPServer(name string, recorder *httpRecorder) (*httpServer, error) {
+	// Only listen on the loopback interface, to work offline and not expose
+	// the server to the network.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("http server %s: %w", name, err)
+	}
+
+	s := &httpServer{
+		URL:      "http://" + listener.Addr().String(),
+		recorder: recorder,
+	}
+	s.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.serve(name, w, r)
+		}),
+	}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+func (s *httpServers) stop() {
+	for _, server := range s.servers {
+		server.server.Close()
+	}
+}
+
+// requests returns the requests received so far by all the servers.
+func (s *httpServers) requests() []httpRequest {
+	s.recorder.mutex.Lock()
+	defer s.recorder.mutex.Unlock()
+	return append([]httpRequest{}, s.recorder.requests...)
+}
+
+// context returns the URLs of the servers, exposed in the templates as
+// `{{http.<name>}}`.
+func (s *httpServers) context() map[string]string {
+	urls := map[string]string{}
+	for name, server := range s.servers {
+		urls[name] = server.URL
+	}
+	return urls
+}
+
+func (s *httpServer) serve(name string, w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.recorder.mutex.Lock()
+	s.recorder.requests = append(s.recorder.requests, httpRequest{
+		Server: name,
+		Method: r.Method,
+		URI:    r.URL.RequestURI(),
+		Header: r.Header,
+		Body:   string(body),
+	})
+	s.recorder.mutex.Unlock()
+
+	route, ok := s.match(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no route for %s %s\n", r.Method, r.URL.RequestURI())
+		return
+	}
+	for _, header := range route.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		w.Header().Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	w.WriteHeader(route.Status)
+	fmt.Fprint(w, route.Body)
+}
+
+// match returns the first route matching the given request.
+func (s *httpServer) match(r *http.Request) (HTTPRoute, bool) {
+	for _, route := range s.routes {
+		if route.Method != r.Method {
+			continue
+		}
+		path := r.URL.Path
+		if strings.Contains(route.Path, "?") {
+			path = r.URL.RequestURI()
+		}
+		if route.Path == path {
+			return route, true
+		}
+	}
+	return HTTPRoute{}, false
+}
+
+// runRequestsCmd implements the `tesh-requests [-H <header>]... [<server>...]`
+// builtin, printing the requests received by the given servers, or by all of
+// them, in order. Each request is printed with its method and URI, followed
+// by the requested headers and its body.
+func runRequestsCmd(args []string, stdin string, config RunConfig) (cmdResult, error) {
+	headers := []string{}
+	names := map[string]bool{}
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-H" {
+			if i+1 >= len(args) {
+				return cmdResult{}, fmt.Errorf("expected a header name after -H")
+			}
+			headers = append(headers, args[i+1])
+			i++
+			continue
+		}
+		if config.http == nil || config.http.servers[args[i]] == nil {
+			return cmdResult{}, fmt.Errorf("unknown HTTP server: %s", args[i])
+		}
+		names[args[i]] = true
+	}
+	if config.http == nil {
+		return cmdResult{}, nil
+	}
+
+	out := ""
+	for _, request := range config.http.requests() {
+		if len(names) > 0 && !names[request.Server] {
+			continue
+		}
+		out += request.Method + " " + request.URI + "\n"
+		for _, name := range headers {
+			for _, value := range request.Header.Values(name) {
+				out += "  " + http.CanonicalHeaderKey(name) + ": " + value + "\n"
+			}
+		}
+		if request.Body != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(request.Body, "\n"), "\n") {
+				out += "  body: " + line + "\n"
+			}
+		}
+	}
+	return cmdResult{Stdout: out}, nil
+}
@@ -6,49 +6,124 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"unicode"
 )
 
-func ParseSuite(rootDir string) (TestSuiteNode, error) {
+// ParseSuite parses the .tesh files found in the given paths, which can be
+// either test files or directories walked recursively.
+//
+// Tests are named after their path relative to the given directory. When
+// several paths are given, the names are prefixed with them to prevent
+// collisions.
+func ParseSuite(paths ...string) (TestSuiteNode, error) {
 	var suite TestSuiteNode
 
-	err := filepath.Walk(rootDir, func(abs string, info os.FileInfo, err error) error {
+	for _, root := range paths {
+		info, err := os.Stat(root)
 		if err != nil {
-			return err
+			return suite, err
 		}
-		if info.IsDir() {
-			return nil
-		}
-		path, err := filepath.Rel(rootDir, abs)
-		if err != nil {
-			return err
-		}
-		if filepath.Ext(path) != ".tesh" {
-			return nil
+
+		if !info.IsDir() {
+			name := filepath.Base(root)
+			if len(paths) > 1 {
+				name = filepath.Clean(root)
+			}
+			err = parseSuiteFile(&suite, root, name)
+			if err != nil {
+				return suite, err
+			}
+			continue
 		}
 
-		test, err := ParseTestFile(abs)
+		err = filepath.Walk(root, func(abs string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if filepath.Ext(abs) == fixturesExt {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			path, err := filepath.Rel(root, abs)
+			if err != nil {
+				return err
+			}
+			if filepath.Ext(path) != ".tesh" {
+				return nil
+			}
+			if len(paths) > 1 {
+				path = filepath.Join(root, path)
+			}
+			return parseSuiteFile(&suite, abs, path)
+		})
 		if err != nil {
-			return err
+			return suite, err
 		}
+	}
 
-		test.Name = path
-		test.Path = abs
-		suite.Tests = append(suite.Tests, test)
-		return nil
-	})
+	return suite, nil
+}
+
+func parseSuiteFile(suite *TestSuiteNode, path string, name string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	test, err := ParseTestFile(abs)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
 
-	return suite, err
+	test.Name = name
+	test.Path = abs
+	suite.Tests = append(suite.Tests, test)
+	return nil
 }
 
+// Extension of the fixture directories found next to the test files, e.g.
+// `foo.fixtures/` for `foo.tesh`.
+const fixturesExt = ".fixtures"
+
 func ParseTestFile(path string) (TestNode, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return TestNode{}, err
 	}
-	return ParseTest(string(data))
+	test, err := ParseTest(string(data))
+	if err != nil {
+		return test, err
+	}
+
+	// The fixtures are relative to the test file.
+	dir := filepath.Dir(path)
+	for i, fixture := range test.Fixtures {
+		if !filepath.IsAbs(fixture) {
+			fixture = filepath.Join(dir, fixture)
+		}
+		if _, err := os.Stat(fixture); err != nil {
+			return test, fmt.Errorf("invalid `fixtures` directive: %w", err)
+		}
+		test.Fixtures[i] = fixture
+	}
+
+	// So are the routes files of the HTTP servers.
+	for i, route := range test.HTTP {
+		if route.File != "" && !filepath.IsAbs(route.File) {
+			test.HTTP[i].File = filepath.Join(dir, route.File)
+		}
+	}
+
+	fixture := strings.TrimSuffix(path, filepath.Ext(path)) + fixturesExt
+	if info, err := os.Stat(fixture); err == nil && info.IsDir() {
+		test.Fixtures = append(test.Fixtures, fixture)
+	}
+
+	return test, nil
 }
 
 func ParseTest(content string) (TestNode, error) {
@@ -58,34 +133,61 @@ func ParseTest(content string) (TestNode, error) {
 		return script, err
 	}
 
+	// A shebang on the first line, e.g. `#!/bin/bash -e`, is equivalent to
+	// the `shell` directive.
+	if len(lines) > 0 {
+		if line, ok := lines[0].(CommentLine); ok && line.Shebang {
+			shebang := strings.SplitN(line.Content, "\n", 2)[0]
+			err = applyTestDirective(Directive{Name: "shell", Args: strings.TrimPrefix(shebang, "!")}, &script)
+			if err != nil {
+				return script, fmt.Errorf("invalid shebang: %w", err)
+			}
+		}
+	}
+
 	comment := CommentNode{}
 	var cmd *CommandNode
 
-	flushComment := func() {
-		if !comment.IsEmpty() {
-			script.Children = append(script.Children, comment)
-			comment = CommentNode{}
+	flushComment := func() error {
+		if comment.IsEmpty() {
+			return nil
 		}
+		script.Children = append(script.Children, comment)
+		err := applyDirectives(comment, &script, nil)
+		comment = CommentNode{}
+		return err
 	}
 
-	for _, line := range lines {
+	for i, line := range lines {
 		switch line := line.(type) {
 		case BlankLine:
-			flushComment()
+			if err := flushComment(); err != nil {
+				return script, err
+			}
 			script.Children = append(script.Children, SpacerNode{Lines: line.Count})
 
 		case CommandLine:
+			if err := checkBackgroundCmd(cmd); err != nil {
+				return script, err
+			}
 			cmd = &CommandNode{
-				Cmd:      line.Cmd,
-				ExitCode: line.ExitCode,
-				Comment:  comment,
+				Cmd:        line.Cmd,
+				ExitCode:   line.ExitCode,
+				Background: line.Background,
+				Comment:    comment,
 			}
 			script.Children = append(script.Children, cmd)
+			if err := applyDirectives(comment, &script, cmd); err != nil {
+				return script, err
+			}
 			comment = CommentNode{}
 
 		case CommentLine:
-			flushComment()
+			if err := flushComment(); err != nil {
+				return script, err
+			}
 			comment.Content = line.Content
+			comment.Shebang = i == 0 && line.Shebang
 
 		case DataLine:
 			// For now we discard any comment above data.
@@ -93,6 +195,17 @@ func ParseTest(content string) (TestNode, error) {
 			if cmd == nil {
 				return script, fmt.Errorf("unexpected data line before any command: `%s`", line.Content)
 			}
+			line.Content, err = line.Encoding.decode(line.Content)
+			if err != nil {
+				return script, err
+			}
+			line, err = parseGoldenLine(line)
+			if err != nil {
+				return script, err
+			}
+			if err := checkDataLine(*cmd, line); err != nil {
+				return script, err
+			}
 			switch line.FD {
 			case Stdin:
 				cmd.Stdin = cmd.Stdin.Append(line)
@@ -100,6 +213,11 @@ func ParseTest(content string) (TestNode, error) {
 				cmd.Stdout = cmd.Stdout.Append(line)
 			case Stderr:
 				cmd.Stderr = cmd.Stderr.Append(line)
+			case Combined:
+				cmd.Combined = cmd.Combined.Append(line)
+			case File:
+				file := cmd.file(line.Path)
+				file.Data = file.Data.Append(line)
 			}
 
 		default:
@@ -107,7 +225,86 @@ func ParseTest(content string) (TestNode, error) {
 		}
 	}
 
-	return script, nil
+	if err := checkBackgroundCmd(cmd); err != nil {
+		return script, err
+	}
+	err = flushComment()
+	return script, err
+}
+
+// checkBackgroundCmd returns an error if outputs are expected from a
+// background command, as they are asserted when stopping it.
+func checkBackgroundCmd(cmd *CommandNode) error {
+	if cmd == nil || cmd.Background == "" {
+		return nil
+	}
+	if !cmd.Stdout.IsEmpty() || !cmd.Stderr.IsEmpty() || !cmd.Combined.IsEmpty() || len(cmd.Files) > 0 {
+		return fmt.Errorf("unexpected output for the background command `%s`, assert it with `tesh-stop %s` or `tesh-wait %s`", cmd.Cmd, cmd.Background, cmd.Background)
+	}
+	return nil
+}
+
+// checkDataLine returns an error if the data line doesn't have the same
+// encoding as the previous lines of its stream, or if a combined output is
+// mixed with separate stdout and stderr outputs.
+func checkDataLine(cmd CommandNode, line DataLine) error {
+	data := cmd.Stdin
+	switch line.FD {
+	case Stdout:
+		data = cmd.Stdout
+	case Stderr:
+		data = cmd.Stderr
+	case Combined:
+		data = cmd.Combined
+	case File:
+		for _, file := range cmd.Files {
+			if file.Path == line.Path {
+				data = file.Data
+			}
+		}
+	}
+	if !data.IsEmpty() && data.Encoding != line.Encoding {
+		return fmt.Errorf("mixed encodings on %s for the command `%s`", line.FD, cmd.Cmd)
+	}
+	if !data.IsEmpty() && data.Format != line.Format {
+		return fmt.Errorf("mixed formats on %s for the command `%s`", line.FD, cmd.Cmd)
+	}
+	if !data.IsEmpty() && (data.Golden != "" || line.Golden != "") {
+		return fmt.Errorf("a golden file must be the only data on %s for the command `%s`", line.FD, cmd.Cmd)
+	}
+
+	hasSeparateOutputs := !cmd.Stdout.IsEmpty() || !cmd.Stderr.IsEmpty()
+	if (line.FD == Combined && hasSeparateOutputs) || ((line.FD == Stdout || line.FD == Stderr) && !cmd.Combined.IsEmpty()) {
+		return fmt.Errorf("unexpected combined output with separate stdout and stderr outputs for the command `%s`", cmd.Cmd)
+	}
+	return nil
+}
+
+// parseGoldenLine reads the path of the golden file referenced by an output
+// block made of a single line `>@path`. A single line starting with `@` is
+// written `>\@` to be read literally.
+func parseGoldenLine(line DataLine) (DataLine, error) {
+	if line.FD == Stdin || line.FD == Combined || line.Encoding != NoEncoding {
+		return line, nil
+	}
+	if isGoldenLine(line.Content) {
+		line.Golden = strings.TrimSpace(strings.TrimPrefix(line.Content, "@"))
+		line.Content = ""
+		if line.Golden == "" {
+			return line, fmt.Errorf("expected a golden file path after `@`")
+		}
+	} else if strings.HasPrefix(line.Content, "\\") && isGoldenLine(line.Content[1:]) {
+		line.Content = line.Content[1:]
+	}
+	return line, nil
+}
+
+// isGoldenLine returns whether the given data is a single line starting with
+// `@`, which references a golden file.
+func isGoldenLine(data string) bool {
+	return strings.HasPrefix(data, "@") &&
+		strings.HasSuffix(data, "\n") &&
+		!strings.Contains(strings.TrimSuffix(data, "\n"), "\n")
 }
 
 func parseLines(content string) ([]Line, error) {
@@ -146,6 +343,14 @@ func parseLine(line string) (Line, error) {
 	}
 
 	var prefix string
+	// The path of a file output is read as is, as it may contain
+	// whitespaces.
+	if trimmed := strings.TrimLeftFunc(line, unicode.IsSpace); strings.HasPrefix(trimmed, "[") {
+		if end := strings.Index(trimmed, "]"); end >= 0 {
+			prefix = trimmed[:end+1]
+			line = trimmed[end+1:]
+		}
+	}
 	for i, char := range line {
 		if unicode.IsSpace(char) {
 			continue
@@ -172,12 +377,23 @@ func parseComment(prefix, line string) (Line, error) {
 	if prefix != "" {
 		return nil, fmt.Errorf("a comment must start on its own line")
 	}
-	return CommentLine{Content: strings.TrimSpace(line)}, nil
+	return CommentLine{
+		Content: strings.TrimSpace(line),
+		Shebang: strings.HasPrefix(line, "!"),
+	}, nil
 }
 
+var backgroundNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
 func parseCommand(prefix, line string) (Line, error) {
 	exitCode := 0
-	if prefix != "" {
+	background := ""
+	if strings.HasPrefix(prefix, "&") {
+		background = strings.TrimPrefix(prefix, "&")
+		if !backgroundNameRegex.MatchString(background) {
+			return nil, fmt.Errorf("invalid background process name: `%s`", background)
+		}
+	} else if prefix != "" {
 		var err error
 		exitCode, err = strconv.Atoi(prefix)
 		if err != nil {
@@ -189,33 +405,61 @@ func parseCommand(prefix, line string) (Line, error) {
 		return nil, fmt.Errorf("unexpected empty command")
 	}
 	return CommandLine{
-		Cmd:      cmd,
-		ExitCode: exitCode,
+		Cmd:        cmd,
+		ExitCode:   exitCode,
+		Background: background,
 	}, nil
 }
 
 func parseInput(prefix, line string) (Line, error) {
-	if prefix != "" {
+	encoding, ok := encodings[prefix]
+	if prefix != "" && !ok {
 		return nil, fmt.Errorf("invalid data prefix: `%s`", prefix)
 	}
-	return parseDataLine(line, Stdin), nil
+	return parseDataLine(line, Stdin, encoding), nil
 }
 
 func parseOutput(prefix, line string) (Line, error) {
+	if prefix == "&" || prefix == "&2" {
+		// The lines of a combined output keep their prefix, to tell the
+		// origin of each line.
+		return DataLine{FD: Combined, Content: prefix + ">" + line + "\n"}, nil
+	}
+
 	fd := Stdout
-	if prefix == "2" {
+	name := prefix
+	path := ""
+	if strings.HasPrefix(name, "[") {
+		end := strings.Index(name, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid data prefix: `%s`", prefix)
+		}
+		path = strings.TrimSpace(name[1:end])
+		if path == "" {
+			return nil, fmt.Errorf("expected a file path in the data prefix: `%s`", prefix)
+		}
+		fd = File
+		name = name[end+1:]
+	} else if strings.HasPrefix(name, "2") {
 		fd = Stderr
-	} else if prefix != "" {
+		name = strings.TrimPrefix(name, "2")
+	}
+	encoding, isEncoding := encodings[name]
+	format, isFormat := formats[name]
+	if name != "" && !isEncoding && !isFormat {
 		return nil, fmt.Errorf("invalid data prefix: `%s`", prefix)
 	}
-	return parseDataLine(line, fd), nil
+	data := parseDataLine(line, fd, encoding)
+	data.Format = format
+	data.Path = path
+	return data, nil
 }
 
-func parseDataLine(line string, fd FD) DataLine {
+func parseDataLine(line string, fd FD, encoding Encoding) DataLine {
 	if strings.HasSuffix(line, "\\") {
 		line = strings.TrimSuffix(line, "\\")
 	} else {
 		line += "\n"
 	}
-	return DataLine{FD: fd, Content: line}
+	return DataLine{FD: fd, Content: line, Encoding: encoding}
 }
@@ -2,6 +2,7 @@ package tesh
 
 import (
 	"testing"
+	"time"
 
 	"github.com/mickael-menu/tesh/pkg/internal/util/test/assert"
 )
@@ -70,10 +71,599 @@ func TestParseScriptRequireDataNodeUnderACommand(t *testing.T) {
 	testParseScriptErr(t, ">data", "unexpected data line before any command: `data\n`")
 }
 
-func testParseScript(t *testing.T, content string, expected TestNode) {
+func TestParseScriptTags(t *testing.T) {
+	testParseScript(t, `# tags: slow, network
+# tags: git
+
+# Comment
+$ echo "hello"
+`, TestNode{
+		Tags: []string{"slow", "network", "git"},
+		Children: []Node{
+			CommentNode{Content: "tags: slow, network\ntags: git"},
+			SpacerNode{Lines: 1},
+			&CommandNode{
+				Comment: CommentNode{Content: "Comment"},
+				Cmd:     `echo "hello"`,
+			},
+		},
+	})
+}
+
+func TestParseScriptTagsAboveCommand(t *testing.T) {
+	testParseScript(t, `# tags: slow
+$ echo "hello"`, TestNode{
+		Tags: []string{"slow"},
+		Children: []Node{
+			&CommandNode{
+				Comment: CommentNode{Content: "tags: slow"},
+				Cmd:     `echo "hello"`,
+			},
+		},
+	})
+}
+
+func TestParseScriptTrailingComment(t *testing.T) {
+	testParseScript(t, `$ echo "hello"
+# tags: slow`, TestNode{
+		Tags: []string{"slow"},
+		Children: []Node{
+			&CommandNode{Cmd: `echo "hello"`},
+			CommentNode{Content: "tags: slow"},
+		},
+	})
+}
+
+func TestParseScriptEmptyTags(t *testing.T) {
+	testParseScriptErr(t, "# tags:", "invalid `tags` directive: expected at least one tag")
+}
+
+func TestParseScriptSkipOnlyXFail(t *testing.T) {
+	testParseScript(t, `# skip: not ready
+# only
+# xfail
+
+# skip
+$ echo "hello"`, TestNode{
+		Skip:  Marker{Set: true, Reason: "not ready"},
+		Only:  true,
+		XFail: Marker{Set: true},
+		Children: []Node{
+			CommentNode{Content: "skip: not ready\nonly\nxfail"},
+			SpacerNode{Lines: 1},
+			&CommandNode{
+				Comment: CommentNode{Content: "skip"},
+				Cmd:     `echo "hello"`,
+				Skip:    Marker{Set: true},
+			},
+		},
+	})
+}
+
+func TestParseScriptOnlyWithArguments(t *testing.T) {
+	testParseScriptErr(t, "# only: me", "invalid `only` directive: unexpected arguments: `me`")
+}
+
+func TestParseScriptRequires(t *testing.T) {
+	testParseScript(t, `# requires: git, jq $EDITOR
+
+# requires: $(test "$(uname)" = Linux) sh
+$ echo "hello"`, TestNode{
+		Requires: []string{"git", "jq", "$EDITOR"},
+		Children: []Node{
+			CommentNode{Content: "requires: git, jq $EDITOR"},
+			SpacerNode{Lines: 1},
+			&CommandNode{
+				Comment:  CommentNode{Content: `requires: $(test "$(uname)" = Linux) sh`},
+				Cmd:      `echo "hello"`,
+				Requires: []string{`$(test "$(uname)" = Linux)`, "sh"},
+			},
+		},
+	})
+}
+
+func TestParseScriptRequiresUnclosedCondition(t *testing.T) {
+	testParseScriptErr(t, "# requires: $(test -d dir", "invalid `requires` directive: unclosed shell condition: `$(test -d dir`")
+}
+
+func TestParseScriptShebang(t *testing.T) {
+	test := testParseScript(t, `#!/usr/bin/env bash -o pipefail
+# Comment
+$ echo "hello"`, TestNode{
+		Shell: []string{"/usr/bin/env", "bash", "-o", "pipefail"},
+		Children: []Node{
+			&CommandNode{
+				Comment: CommentNode{Content: "!/usr/bin/env bash -o pipefail\nComment", Shebang: true},
+				Cmd:     `echo "hello"`,
+			},
+		},
+	})
+	assert.Equal(t, test.Dump(), "#!/usr/bin/env bash -o pipefail\n# Comment\n$ echo \"hello\"\n")
+}
+
+func TestParseScriptShebangOnlyOnFirstLine(t *testing.T) {
+	testParseScript(t, "\n#!/bin/bash", TestNode{Children: []Node{
+		SpacerNode{Lines: 1},
+		CommentNode{Content: "!/bin/bash"},
+	}})
+
+	// A comment starting with `!` is not a shebang.
+	test := testParseScript(t, "# !important\n$ cmd\n\n#!not a shebang\n# !important\n$ cmd", TestNode{Children: []Node{
+		&CommandNode{Comment: CommentNode{Content: "!important"}, Cmd: "cmd"},
+		SpacerNode{Lines: 1},
+		&CommandNode{Comment: CommentNode{Content: "!not a shebang\n!important"}, Cmd: "cmd"},
+	}})
+	assert.Equal(t, test.Dump(), "# !important\n$ cmd\n\n# !not a shebang\n# !important\n$ cmd\n")
+}
+
+func TestParseScriptShellDirective(t *testing.T) {
+	testParseScript(t, `# shell: zsh -e`, TestNode{
+		Shell: []string{"zsh", "-e"},
+		Children: []Node{
+			CommentNode{Content: "shell: zsh -e"},
+		},
+	})
+}
+
+func TestParseScriptFixtures(t *testing.T) {
+	testParseScript(t, `# fixtures: notebook, ../config`, TestNode{
+		Fixtures: []string{"notebook", "../config"},
+		Children: []Node{
+			CommentNode{Content: "fixtures: notebook, ../config"},
+		},
+	})
+}
+
+func TestParseScriptGit(t *testing.T) {
+	testParseScript(t, `# git: file "notes/a b.md" "# Title\n"
+# git: commit Add a note`, TestNode{
+		Git: []GitStep{
+			{Op: "file", Args: []string{"notes/a b.md", "# Title\n"}},
+			{Op: "commit", Args: []string{"Add", "a", "note"}},
+		},
+		Children: []Node{
+			CommentNode{Content: "git: file \"notes/a b.md\" \"# Title\\n\"\ngit: commit Add a note"},
+		},
+	})
+}
+
+func TestParseScriptGitInvalid(t *testing.T) {
+	testParseScriptErr(t, "# git: push", "invalid `git` directive: unknown step: `push`")
+	testParseScriptErr(t, "# git: branch", "invalid `git` directive: wrong number of arguments for `branch`")
+	testParseScriptErr(t, `# git: file "a.txt`, "invalid `git` directive: unclosed quoted string: `\"a.txt`")
+}
+
+func TestParseScriptStubs(t *testing.T) {
+	testParseScript(t, `# stub: open
+
+# stub: git stderr "fatal: not a git repository\n" exit 128
+# stub: editor run echo "edited" >> "$1"
+# stub: pager stdout "paged" stdin
+# stub: upper stdin run tr a-z A-Z
+$ editor file`, TestNode{
+		Stubs: []Stub{{Name: "open"}},
+		Children: []Node{
+			CommentNode{Content: "stub: open"},
+			SpacerNode{Lines: 1},
+			&CommandNode{
+				Comment: CommentNode{Content: "stub: git stderr \"fatal: not a git repository\\n\" exit 128\nstub: editor run echo \"edited\" >> \"$1\"\nstub: pager stdout \"paged\" stdin\nstub: upper stdin run tr a-z A-Z"},
+				Cmd:     "editor file",
+				Stubs: []Stub{
+					{Name: "git", Stderr: "fatal: not a git repository\n", ExitCode: 128},
+					{Name: "editor", Script: `echo "edited" >> "$1"`},
+					{Name: "pager", Stdout: "paged", Stdin: true},
+					{Name: "upper", Script: "tr a-z A-Z", Stdin: true},
+				},
+			},
+		},
+	})
+}
+
+func TestParseScriptStubsInvalid(t *testing.T) {
+	testParseScriptErr(t, "# stub:", "invalid `stub` directive: expected the name of the stubbed executable")
+	testParseScriptErr(t, "# stub: bin/git", "invalid `stub` directive: invalid executable name: `bin/git`")
+	testParseScriptErr(t, "# stub: git exit", "invalid `stub` directive: expected a value for `exit`")
+	testParseScriptErr(t, "# stub: git exit one", "invalid `stub` directive: invalid exit code: `one`")
+	testParseScriptErr(t, "# stub: git input foo", "invalid `stub` directive: unknown stub option: `input`")
+	testParseScriptErr(t, "# stub: git stdin foo", "invalid `stub` directive: expected a value for `foo`")
+	testParseScriptErr(t, "# stub: git run", "invalid `stub` directive: expected a script to run")
+}
+
+func TestParseScriptHTTP(t *testing.T) {
+	testParseScript(t, `# http: api GET /notes
+# http: api post /notes?dry-run=1 201 body "{}" header "Content-Type: application/json"
+# http: auth routes auth.json`, TestNode{
+		HTTP: []HTTPRoute{
+			{Server: "api", Method: "GET", Path: "/notes", Status: 200},
+			{Server: "api", Method: "POST", Path: "/notes?dry-run=1", Status: 201, Body: "{}", Headers: []string{"Content-Type: application/json"}},
+			{Server: "auth", Status: 200, File: "auth.json"},
+		},
+		Children: []Node{
+			CommentNode{Content: "http: api GET /notes\nhttp: api post /notes?dry-run=1 201 body \"{}\" header \"Content-Type: application/json\"\nhttp: auth routes auth.json"},
+		},
+	})
+}
+
+func TestParseScriptHTTPInvalid(t *testing.T) {
+	testParseScriptErr(t, "# http: api GET", "invalid `http` directive: expected a server name, a method and a path")
+	testParseScriptErr(t, "# http: api FETCH /", "invalid `http` directive: unknown HTTP method: `FETCH`")
+	testParseScriptErr(t, "# http: api GET notes", "invalid `http` directive: expected an absolute path: `notes`")
+	testParseScriptErr(t, "# http: api GET / 42", "invalid `http` directive: invalid status code: `42`")
+	testParseScriptErr(t, "# http: api GET / header Accept", "invalid `http` directive: invalid header: `Accept`")
+	testParseScriptErr(t, "# http: api GET / json {}", "invalid `http` directive: unknown route option: `json`")
+}
+
+func TestParseScriptBackground(t *testing.T) {
+	test := testParseScript(t, `# ready: line ^Listening on \d+ within 5s
+&server$ my-server --port 8080
+<input
+$ tesh-stop server
+>Listening on 8080`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Comment:    CommentNode{Content: "ready: line ^Listening on \\d+ within 5s"},
+				Cmd:        "my-server --port 8080",
+				Background: "server",
+				Ready:      ReadyCondition{Kind: "line", Pattern: `^Listening on \d+`, Timeout: 5 * time.Second},
+				Stdin:      DataNode{Content: "input\n"},
+			},
+			&CommandNode{
+				Cmd:    "tesh-stop server",
+				Stdout: DataNode{Content: "Listening on 8080\n"},
+			},
+		},
+	})
+	assert.Equal(t, test.Dump(), "# ready: line ^Listening on \\d+ within 5s\n&server$ my-server --port 8080\n<input\n$ tesh-stop server\n>Listening on 8080\n")
+
+	testParseScript(t, `# ready: port 8080
+&db$ my-db
+# ready: file db.pid
+&db-2$ my-db`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Comment:    CommentNode{Content: "ready: port 8080"},
+				Cmd:        "my-db",
+				Background: "db",
+				Ready:      ReadyCondition{Kind: "port", Port: 8080, Timeout: 10 * time.Second},
+			},
+			&CommandNode{
+				Comment:    CommentNode{Content: "ready: file db.pid"},
+				Cmd:        "my-db",
+				Background: "db-2",
+				Ready:      ReadyCondition{Kind: "file", Pattern: "db.pid", Timeout: 10 * time.Second},
+			},
+		},
+	})
+
+	// A regex containing ` within `.
+	testParseScript(t, `# ready: line done within the limit within 2s
+&job$ my-job
+# ready: line ^done within \d+ms
+&job-2$ my-job`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Comment:    CommentNode{Content: "ready: line done within the limit within 2s"},
+				Cmd:        "my-job",
+				Background: "job",
+				Ready:      ReadyCondition{Kind: "line", Pattern: "done within the limit", Timeout: 2 * time.Second},
+			},
+			&CommandNode{
+				Comment:    CommentNode{Content: "ready: line ^done within \\d+ms"},
+				Cmd:        "my-job",
+				Background: "job-2",
+				Ready:      ReadyCondition{Kind: "line", Pattern: `^done within \d+ms`, Timeout: 10 * time.Second},
+			},
+		},
+	})
+}
+
+func TestParseScriptBackgroundInvalid(t *testing.T) {
+	testParseScriptErr(t, "&my.server$ cmd", "invalid background process name: `my.server`, line 1")
+	testParseScriptErr(t, "&server$ cmd\n>output", "unexpected output for the background command `cmd`, assert it with `tesh-stop server` or `tesh-wait server`")
+	testParseScriptErr(t, "# ready: port 80\n$ cmd", "invalid `ready` directive: expected a background command below, e.g. `&server$ cmd`")
+	testParseScriptErr(t, "# ready: port 80\n\n&server$ cmd", "invalid `ready` directive: expected a background command below")
+	testParseScriptErr(t, "# ready: port http\n&server$ cmd", "invalid `ready` directive: invalid port: `http`")
+	testParseScriptErr(t, "# ready: pid 12\n&server$ cmd", "invalid `ready` directive: unknown condition: `pid`")
+	testParseScriptErr(t, "# ready: port 80 within soon\n&server$ cmd", "invalid `ready` directive: invalid port: `80 within soon`")
+}
+
+func TestParseScriptSignals(t *testing.T) {
+	testParseScript(t, `# signal: int on ^Listening on \d+
+# signal: SIGKILL after 1.5s
+$ my-server`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Comment: CommentNode{Content: "signal: int on ^Listening on \\d+\nsignal: SIGKILL after 1.5s"},
+				Cmd:     "my-server",
+				Signals: []SignalTrigger{
+					{Signal: "INT", On: `^Listening on \d+`},
+					{Signal: "KILL", After: 1500 * time.Millisecond},
+				},
+			},
+		},
+	})
+}
+
+func TestParseScriptSignalsInvalid(t *testing.T) {
+	testParseScriptErr(t, "# signal: INT\n$ cmd", "invalid `signal` directive: expected `<signal> after <duration>` or `<signal> on <regex>`")
+	testParseScriptErr(t, "# signal: STOP after 1s\n$ cmd", "invalid `signal` directive: unsupported signal: `STOP`")
+	testParseScriptErr(t, "# signal: INT before 1s\n$ cmd", "invalid `signal` directive: expected `after` or `on`, got `before`")
+	testParseScriptErr(t, "# signal: INT after soon\n$ cmd", "invalid `signal` directive: invalid duration")
+	testParseScriptErr(t, "# signal: INT after 1s\n\n$ cmd", "invalid `signal` directive: expected a command below")
+}
+
+func TestParseScriptRetry(t *testing.T) {
+	testParseScript(t, `# retry: 5s
+$ cat status
+# retry: 2s every 50ms
+$ cat log`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Comment: CommentNode{Content: "retry: 5s"},
+				Cmd:     "cat status",
+				Retry:   RetryPolicy{Timeout: 5 * time.Second, Interval: 100 * time.Millisecond},
+			},
+			&CommandNode{
+				Comment: CommentNode{Content: "retry: 2s every 50ms"},
+				Cmd:     "cat log",
+				Retry:   RetryPolicy{Timeout: 2 * time.Second, Interval: 50 * time.Millisecond},
+			},
+		},
+	})
+}
+
+func TestParseScriptRetryInvalid(t *testing.T) {
+	testParseScriptErr(t, "# retry:\n$ cmd", "invalid `retry` directive: expected `<timeout> [every <interval>]`")
+	testParseScriptErr(t, "# retry: 5s each 1s\n$ cmd", "invalid `retry` directive: expected `<timeout> [every <interval>]`")
+	testParseScriptErr(t, "# retry: forever\n$ cmd", "invalid `retry` directive: invalid timeout: `forever`")
+	testParseScriptErr(t, "# retry: 5s every 0s\n$ cmd", "invalid `retry` directive: invalid interval: `0s`")
+	testParseScriptErr(t, "# retry: 5s\n&server$ cmd", "invalid `retry` directive: a background command can't be retried")
+	testParseScriptErr(t, "# retry: 5s\n\n$ cmd", "invalid `retry` directive: expected a command below")
+}
+
+func TestParseScriptStdinMode(t *testing.T) {
+	testParseScript(t, `# stdin: keep-open
+$ cat
+# stdin: keep-open 2s
+$ cat`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Comment:   CommentNode{Content: "stdin: keep-open"},
+				Cmd:       "cat",
+				StdinMode: StdinMode{KeepOpen: true},
+			},
+			&CommandNode{
+				Comment:   CommentNode{Content: "stdin: keep-open 2s"},
+				Cmd:       "cat",
+				StdinMode: StdinMode{KeepOpen: true, KeepOpenFor: 2 * time.Second},
+			},
+		},
+	})
+}
+
+func TestParseScriptStdinModeInvalid(t *testing.T) {
+	testParseScriptErr(t, "# stdin:\n$ cmd", "invalid `stdin` directive: expected `keep-open [<duration>]`")
+	testParseScriptErr(t, "# stdin: close\n$ cmd", "invalid `stdin` directive: expected `keep-open [<duration>]`")
+	testParseScriptErr(t, "# stdin: keep-open forever\n$ cmd", "invalid `stdin` directive: invalid duration: `forever`")
+	testParseScriptErr(t, "# stdin: keep-open\n\n$ cmd", "invalid `stdin` directive: expected a command below")
+}
+
+func TestParseScriptEncodedData(t *testing.T) {
+	test := testParseScript(t, `$ gzip -d
+base64<H4sIAAAAAAAAA8tIzcnJBwCGphA2BQAAAA==
+hex>68 65 6c
+hex>6c 6f
+2hex>00ff`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Cmd:    "gzip -d",
+				Stdin:  DataNode{Content: "\x1f\x8b\b\x00\x00\x00\x00\x00\x00\x03\xcbH\xcd\xc9\xc9\a\x00\x86\xa6\x106\x05\x00\x00\x00", Encoding: Base64Encoding},
+				Stdout: DataNode{Content: "hello", Encoding: HexEncoding},
+				Stderr: DataNode{Content: "\x00\xff", Encoding: HexEncoding},
+			},
+		},
+	})
+
+	assert.Equal(t, test.Dump(), `$ gzip -d
+base64< H4sIAAAAAAAAA8tIzcnJBwCGphA2BQAAAA==
+hex> 68 65 6c 6c 6f
+2hex> 00 ff
+`)
+}
+
+func TestParseScriptEncodedDataInvalid(t *testing.T) {
+	testParseScriptErr(t, "$ cmd\nhex>0g", "invalid hex data")
+	testParseScriptErr(t, "$ cmd\nbase64>A", "invalid base64 data")
+	testParseScriptErr(t, "$ cmd\nutf8>hello", "invalid data prefix: `utf8`")
+	testParseScriptErr(t, "$ cmd\n2utf8>hello", "invalid data prefix: `2utf8`")
+	testParseScriptErr(t, "$ cmd\n>hello\nhex>00", "mixed encodings on stdout for the command `cmd`")
+}
+
+func TestParseScriptCombinedOutput(t *testing.T) {
+	test := testParseScript(t, `$ build
+&>compiling
+&2> warning: unused variable
+&>done\
+&2>!
+&>`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Cmd:      "build",
+				Combined: DataNode{Content: "&>compiling\n&2> warning: unused variable\n&>done\\\n&2>!\n&>\n"},
+			},
+		},
+	})
+
+	assert.Equal(t, test.Dump(), "$ build\n&>compiling\n&2> warning: unused variable\n&>done\\\n&2>!\n&>\n")
+}
+
+func TestParseScriptCombinedOutputInvalid(t *testing.T) {
+	testParseScriptErr(t, "$ cmd\n>out\n&2>err", "unexpected combined output with separate stdout and stderr outputs for the command `cmd`")
+	testParseScriptErr(t, "$ cmd\n&>out\n2>err", "unexpected combined output with separate stdout and stderr outputs for the command `cmd`")
+	testParseScriptErr(t, "$ cmd\n&3>out", "invalid data prefix: `&3`")
+	testParseScriptErr(t, "&server$ cmd\n&>out", "unexpected output for the background command `cmd`")
+}
+
+func TestParseScriptFileOutputs(t *testing.T) {
+	test := testParseScript(t, `$ export
+[out.json]>{"notes": []}
+[logs/export.log]>done
+[out.json]>
+[data.bin]hex>00 ff
+[my file.txt]>hi
+  [ padded.txt ] > text`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Cmd: "export",
+				Files: []FileOutput{
+					{Path: "out.json", Data: DataNode{Content: "{\"notes\": []}\n\n"}},
+					{Path: "logs/export.log", Data: DataNode{Content: "done\n"}},
+					{Path: "data.bin", Data: DataNode{Content: "\x00\xff", Encoding: HexEncoding}},
+					{Path: "my file.txt", Data: DataNode{Content: "hi\n"}},
+					{Path: "padded.txt", Data: DataNode{Content: " text\n"}},
+				},
+			},
+		},
+	})
+
+	assert.Equal(t, test.Dump(), `$ export
+[out.json]>{"notes": []}
+[out.json]>
+[logs/export.log]>done
+[data.bin]hex> 00 ff
+[my file.txt]>hi
+[padded.txt]> text
+`)
+}
+
+func TestParseScriptFileOutputsInvalid(t *testing.T) {
+	testParseScriptErr(t, "$ cmd\n[]>content", "expected a file path in the data prefix: `[]`")
+	testParseScriptErr(t, "$ cmd\n[ ]>content", "expected a file path in the data prefix: `[ ]`")
+	testParseScriptErr(t, "$ cmd\n[out>content", "invalid data prefix: `[out`")
+	testParseScriptErr(t, "$ cmd\n[out]2>content", "invalid data prefix: `[out]2`")
+	testParseScriptErr(t, "$ cmd\n[out]>text\n[out]hex>00", "mixed encodings on file for the command `cmd`")
+	testParseScriptErr(t, "&server$ cmd\n[out]>content", "unexpected output for the background command `cmd`")
+}
+
+func TestParseScriptGoldenFiles(t *testing.T) {
+	test := testParseScript(t, `$ list
+>@golden/list.txt
+2>@ golden/errors.txt
+[out.json]>@golden/out.json
+
+$ whoami
+>\@mickael
+
+$ mentions
+>@mickael
+>@john`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Cmd:    "list",
+				Stdout: DataNode{Golden: "golden/list.txt"},
+				Stderr: DataNode{Golden: "golden/errors.txt"},
+				Files: []FileOutput{
+					{Path: "out.json", Data: DataNode{Golden: "golden/out.json"}},
+				},
+			},
+			SpacerNode{Lines: 1},
+			&CommandNode{
+				Cmd:    "whoami",
+				Stdout: DataNode{Content: "@mickael\n"},
+			},
+			SpacerNode{Lines: 1},
+			&CommandNode{
+				Cmd:    "mentions",
+				Stdout: DataNode{Content: "@mickael\n@john\n"},
+			},
+		},
+	})
+
+	assert.Equal(t, test.Dump(), `$ list
+>@golden/list.txt
+2>@golden/errors.txt
+[out.json]>@golden/out.json
+
+$ whoami
+>\@mickael
+
+$ mentions
+>@mickael
+>@john
+`)
+}
+
+func TestParseScriptGoldenFilesInvalid(t *testing.T) {
+	testParseScriptErr(t, "$ cmd\n>@", "expected a golden file path after `@`")
+	testParseScriptErr(t, "$ cmd\n>@out.txt\n2>err\n>more", "a golden file must be the only data on stdout for the command `cmd`")
+	testParseScriptErr(t, "$ cmd\n>out\n2>err\n>@out.txt", "a golden file must be the only data on stdout for the command `cmd`")
+}
+
+func TestParseScriptStructuredData(t *testing.T) {
+	test := testParseScript(t, `# ignore-keys: created_at
+# ignore-keys: id, $.items[*].updated_at
+$ list --format json
+json>{
+json>  "items": []
+json>}
+2json>@golden/errors.json`, TestNode{
+		Children: []Node{
+			&CommandNode{
+				Comment:    CommentNode{Content: "ignore-keys: created_at\nignore-keys: id, $.items[*].updated_at"},
+				Cmd:        "list --format json",
+				Stdout:     DataNode{Content: "{\n  \"items\": []\n}\n", Format: JSONFormat},
+				Stderr:     DataNode{Golden: "golden/errors.json", Format: JSONFormat},
+				IgnoreKeys: []string{"created_at", "id", "$.items[*].updated_at"},
+			},
+		},
+	})
+
+	assert.Equal(t, test.Dump(), `# ignore-keys: created_at
+# ignore-keys: id, $.items[*].updated_at
+$ list --format json
+json>{
+json>  "items": []
+json>}
+2json>@golden/errors.json
+`)
+
+	test = testParseScript(t, "$ export\ncsv-noheader>1,Hello\ncsv-noheader>2,World", TestNode{
+		Children: []Node{
+			&CommandNode{
+				Cmd:    "export",
+				Stdout: DataNode{Content: "1,Hello\n2,World\n", Format: CSVNoHeaderFormat},
+			},
+		},
+	})
+	assert.Equal(t, test.Dump(), "$ export\ncsv-noheader>1,Hello\ncsv-noheader>2,World\n")
+
+	testParseScript(t, "# ignore-keys: id\n\n$ list", TestNode{
+		Children: []Node{
+			CommentNode{Content: "ignore-keys: id"},
+			SpacerNode{Lines: 1},
+			&CommandNode{Cmd: "list"},
+		},
+		IgnoreKeys: []string{"id"},
+	})
+}
+
+func TestParseScriptStructuredDataInvalid(t *testing.T) {
+	testParseScriptErr(t, "$ cmd\njson<{}", "invalid data prefix: `json`")
+	testParseScriptErr(t, "$ cmd\n>text\n2>err\njson>{}", "mixed formats on stdout for the command `cmd`")
+	testParseScriptErr(t, "# ignore-keys:\n$ cmd", "invalid `ignore-keys` directive: expected at least one key")
+}
+
+func TestParseScriptIgnoresUnknownDirectives(t *testing.T) {
+	testParseScript(t, "# note: this is a comment", TestNode{Children: []Node{
+		CommentNode{Content: "note: this is a comment"},
+	}})
+}
+
+func testParseScript(t *testing.T, content string, expected TestNode) TestNode {
 	actual, err := ParseTest(content)
 	assert.Nil(t, err)
 	assert.Equal(t, actual, expected)
+	return actual
 }
 
 func testParseScriptErr(t *testing.T, content string, msg string) {
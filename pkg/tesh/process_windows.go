@@ -0,0 +1,21 @@
+package tesh
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Signals and process groups are not supported on Windows, the process
+// itself is killed instead.
+
+var signalsByName = map[string]syscall.Signal{
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(cmd *exec.Cmd, signal syscall.Signal) {
+	_ = cmd.Process.Kill()
+}
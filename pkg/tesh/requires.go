@@ -0,0 +1,129 @@
+package tesh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	executil "github.com/mickael-menu/tesh/pkg/internal/util/exec"
+)
+
+// parseRequirements splits the arguments of a `requires` directive.
+//
+// A requirement is either:
+//   - the name of an executable which must be found in the PATH, e.g. `git`
+//   - an environment variable which must be set, e.g. `$EDITOR`
+//   - a shell condition which must succeed, e.g. `$(test -d /usr/share)`
+func parseRequirements(args string) ([]string, error) {
+	requirements := []string{}
+	current := ""
+	depth := 0
+	for _, char := range args {
+		switch {
+		case depth == 0 && (char == ' ' || char == '\t' || char == ','):
+			if current != "" {
+				requirements = append(requirements, current)
+				current = ""
+			}
+			continue
+		case char == '(' && (depth > 0 || current == "$"):
+			depth += 1
+		case char == ')' && depth > 0:
+			depth -= 1
+		}
+		current += string(char)
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unclosed shell condition: `%s`", current)
+	}
+	if current != "" {
+		requirements = append(requirements, current)
+	}
+	if len(requirements) == 0 {
+		return nil, fmt.Errorf("expected at least one requirement")
+	}
+	return requirements, nil
+}
+
+// checkRequirements returns the reason why the first unmet requirement
+// failed, or an empty string if they are all met.
+func checkRequirements(requirements []string, config RunConfig) string {
+	for _, requirement := range requirements {
+		var unmet string
+		switch {
+		case strings.HasPrefix(requirement, "$("):
+			unmet = checkShellRequirement(strings.TrimSuffix(strings.TrimPrefix(requirement, "$("), ")"), config)
+		case strings.HasPrefix(requirement, "$"):
+			unmet = checkEnvRequirement(strings.TrimPrefix(requirement, "$"), config)
+		default:
+			unmet = checkExecutableRequirement(requirement, config)
+		}
+		if unmet != "" {
+			return fmt.Sprintf("requires `%s`: %s", requirement, unmet)
+		}
+	}
+	return ""
+}
+
+func checkShellRequirement(condition string, config RunConfig) string {
+	cmd := executil.ShellCommand(config.Shell, condition)
+	cmd.Dir = config.WorkingDir
+	cmd.Env = commandEnv(config)
+	if err := cmd.Run(); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// checkEnvRequirement looks for the variable in the environment of the
+// commands, then in the environment of tesh itself.
+func checkEnvRequirement(name string, config RunConfig) string {
+	if value, ok := lookupEnv(commandEnv(config), name); ok && value != "" {
+		return ""
+	}
+	if os.Getenv(name) != "" {
+		return ""
+	}
+	return "environment variable not set"
+}
+
+func checkExecutableRequirement(name string, config RunConfig) string {
+	if strings.Contains(name, "/") {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.WorkingDir, path)
+		}
+		if isExecutable(path) {
+			return ""
+		}
+		return "executable not found"
+	}
+
+	path, ok := lookupEnv(commandEnv(config), "PATH")
+	if !ok {
+		path = os.Getenv("PATH")
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if isExecutable(filepath.Join(dir, name)) {
+			return ""
+		}
+	}
+	return "executable not found in PATH"
+}
+
+// lookupEnv returns the value of the variable with the given name in a list
+// of `KEY=value` pairs.
+func lookupEnv(env []string, name string) (string, bool) {
+	for _, variable := range env {
+		if strings.HasPrefix(variable, name+"=") {
+			return strings.TrimPrefix(variable, name+"="), true
+		}
+	}
+	return "", false
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
@@ -0,0 +1,81 @@
+package tesh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetryPolicy reruns a command until its assertions pass, declared with the
+// `retry` directive, e.g. `# retry: 5s every 100ms`.
+type RetryPolicy struct {
+	// Maximum duration of the retries. Zero when the command is run only
+	// once.
+	Timeout  time.Duration
+	Interval time.Duration
+}
+
+const defaultRetryInterval = 100 * time.Millisecond
+
+// parseRetryPolicy parses the arguments of a `retry` directive:
+// `<timeout> [every <interval>]`.
+func parseRetryPolicy(args string) (RetryPolicy, error) {
+	policy := RetryPolicy{Interval: defaultRetryInterval}
+
+	parts := strings.Fields(args)
+	if len(parts) != 1 && (len(parts) != 3 || parts[1] != "every") {
+		return policy, fmt.Errorf("expected `<timeout> [every <interval>]`")
+	}
+
+	var err error
+	policy.Timeout, err = time.ParseDuration(parts[0])
+	if err != nil || policy.Timeout <= 0 {
+		return policy, fmt.Errorf("invalid timeout: `%s`", parts[0])
+	}
+	if len(parts) == 3 {
+		policy.Interval, err = time.ParseDuration(parts[2])
+		if err != nil || policy.Interval <= 0 {
+			return policy, fmt.Errorf("invalid interval: `%s`", parts[2])
+		}
+	}
+	return policy, nil
+}
+
+// runWithRetry runs the command until its outputs and exit code match the
+// expected ones, or the timeout of the retry policy expires. In this case,
+// the last mismatch is returned, or the command is updated with its last
+// result in update mode.
+func runWithRetry(node *CommandNode, config RunConfig, hasChanges *bool, run func(*CommandNode, RunConfig, *bool) error) error {
+	policy := node.Retry
+	if policy.Timeout == 0 {
+		return run(node, config, hasChanges)
+	}
+
+	deadline := time.Now().Add(policy.Timeout)
+	assertConfig := config
+	assertConfig.Update = false
+	for {
+		err := run(node, assertConfig, hasChanges)
+		if !isAssertError(err) {
+			return err
+		}
+		if time.Now().Add(policy.Interval).After(deadline) {
+			if config.Update {
+				return run(node, config, hasChanges)
+			}
+			return err
+		}
+		time.Sleep(policy.Interval)
+	}
+}
+
+// isAssertError returns whether the error is a mismatch between the result
+// of a command and the expected one.
+func isAssertError(err error) bool {
+	switch err.(type) {
+	case DataAssertError, ExitCodeAssertError:
+		return true
+	default:
+		return false
+	}
+}
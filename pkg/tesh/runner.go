@@ -1,7 +1,6 @@
 package tesh
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -11,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/aymerick/raymond"
+	"github.com/mickael-menu/tesh/pkg/internal/fixture"
 	"github.com/mickael-menu/tesh/pkg/internal/handlebars"
 	_ "github.com/mickael-menu/tesh/pkg/internal/handlebars"
 	"github.com/mickael-menu/tesh/pkg/internal/util/errors"
@@ -25,8 +25,17 @@ type RunCallbacks struct {
 
 	OnStartCommand  func(test TestNode, cmd CommandNode, config RunConfig)
 	OnFinishCommand func(test TestNode, cmd CommandNode, config RunConfig, err error)
+	OnSkipCommand   func(test TestNode, cmd CommandNode, reason string)
 
 	OnComment func(test TestNode, comment string)
+
+	// Called when the temporary working dir of a test is not removed,
+	// according to RunConfig.Keep.
+	OnKeepWorkingDir func(test TestNode, dir string)
+
+	// Called before starting a debug shell for a failed command, in
+	// config.WorkingDir.
+	OnDebugCommand func(test TestNode, cmd CommandNode, config RunConfig)
 }
 
 type ExitCodeAssertError struct {
@@ -44,21 +53,206 @@ func (e ExitCodeAssertError) Error() string {
 }
 
 type DataAssertError struct {
-	FD       FD
+	FD FD
+	// Path of the file which didn't match, when FD is File.
+	Path     string
 	Received string
 	Expected string
+	// Differences found when comparing structured data, prefixed with
+	// their path, e.g. `$.items[3].title: expected "a" got "b"`.
+	Mismatches []string
 }
 
 func (e DataAssertError) Error() string {
-	return fmt.Sprintf("expected on %s: `%s` got: `%s`", e.FD.String(), e.Expected, e.Received)
+	if len(e.Mismatches) > 0 {
+		return fmt.Sprintf("expected on %s:\n%s", e.Target(), strings.Join(e.Mismatches, "\n"))
+	}
+	return fmt.Sprintf("expected on %s: `%s` got: `%s`", e.Target(), e.Expected, e.Received)
+}
+
+// Target returns the name of the stream, or the path of the file, which
+// didn't match.
+func (e DataAssertError) Target() string {
+	if e.FD == File {
+		return e.Path
+	}
+	return e.FD.String()
+}
+
+// SkipError is returned when a test was skipped, for example with the `skip`
+// directive.
+type SkipError struct {
+	Reason string
+}
+
+func (e SkipError) Error() string {
+	if e.Reason == "" {
+		return "skipped"
+	}
+	return "skipped: " + e.Reason
+}
+
+// XFailError is returned when a test marked with `xfail` failed as expected.
+type XFailError struct {
+	Reason string
+	Err    error
+}
+
+func (e XFailError) Error() string {
+	out := "expected failure"
+	if e.Reason != "" {
+		out += " (" + e.Reason + ")"
+	}
+	return out + ": " + e.Err.Error()
+}
+
+func (e XFailError) Unwrap() error {
+	return e.Err
+}
+
+// UnexpectedPassError is returned when a test marked with `xfail` passed.
+type UnexpectedPassError struct {
+	Reason string
+}
+
+func (e UnexpectedPassError) Error() string {
+	out := "expected to fail, but passed"
+	if e.Reason != "" {
+		out += " (" + e.Reason + ")"
+	}
+	return out
+}
+
+// SetupError is returned when a test could not be set up, for example when
+// installing its fixtures failed.
+type SetupError struct {
+	Err error
+}
+
+func (e SetupError) Error() string {
+	return "setup failed: " + e.Err.Error()
+}
+
+func (e SetupError) Unwrap() error {
+	return e.Err
+}
+
+// DebugAbortError is returned when the user aborted the run from the debug
+// shell of a failed command.
+type DebugAbortError struct {
+	Err error
+}
+
+func (e DebugAbortError) Error() string {
+	return "aborted from the debug shell"
+}
+
+func (e DebugAbortError) Unwrap() error {
+	return e.Err
 }
 
 type RunConfig struct {
 	// When true, will overwrite the test to make them pass.
 	Update     bool
 	WorkingDir string
-	Callbacks  RunCallbacks
-	context    map[string]interface{}
+	// Shell used to run the commands, with its options, e.g.
+	// []string{"bash", "-o", "pipefail"}. Defaults to $SHELL.
+	// Tests can override it with the `shell` directive.
+	Shell []string
+	// Additional environment variables given to the commands, e.g. `KEY=value`.
+	Env []string
+	// When not empty, each test of a suite is run once per matrix entry.
+	Matrix []MatrixEntry
+	// How the files of WorkingDir are installed in the temporary working
+	// dir of each test: "copy" (default), "hardlink" or "reflink".
+	// WorkingDir can also be an archive, which is extracted.
+	FixtureStrategy string
+	// Whether to keep the temporary working dirs after running the tests.
+	Keep KeepMode
+	// When true, an interactive shell is started in the working dir of a
+	// failed command. The run resumes when the shell exits successfully,
+	// or is aborted otherwise.
+	Debug     bool
+	Callbacks RunCallbacks
+	context   map[string]interface{}
+	matrix    string
+	// Root of the temporary working dir of the test.
+	tempDir string
+	// Temporary dir holding the state of the test outside of its working
+	// dir, such as its stubs.
+	stateDir string
+	// Dir of the stub executables, put first in the PATH of the commands.
+	stubsDir string
+	// Stub HTTP servers of the test.
+	http *httpServers
+	// Processes started in the background by the commands of the test.
+	background *backgroundProcs
+	// Dir of the test file, used to resolve the golden files.
+	testDir string
+	// Keys ignored when comparing structured data, declared with the
+	// `ignore-keys` directive.
+	ignoredKeys []string
+	// Whether the test was already checked for being skipped, before
+	// installing its fixtures.
+	skipChecked bool
+}
+
+type KeepMode int
+
+const (
+	// The temporary working dirs are always removed.
+	KeepNever KeepMode = iota
+	// The temporary working dirs of the failed tests are kept, with a
+	// script reproducing the failed command.
+	KeepOnFailure
+	// The temporary working dirs are always kept.
+	KeepAlways
+)
+
+// ReproScriptName is the name of the script reproducing the failed command,
+// written in a kept working dir.
+const ReproScriptName = "tesh-repro.sh"
+
+// MatrixEntry is a variant of the run configuration, used to run each test
+// of a suite with different shells or environment variables.
+type MatrixEntry struct {
+	// Name identifying the entry in the test names, and exposed as the
+	// `matrix` template variable.
+	Name string
+	// Shell overriding RunConfig.Shell, if not empty.
+	Shell []string
+	// Additional environment variables, e.g. `KEY=value`.
+	Env []string
+}
+
+// ParseMatrixEntry parses a matrix entry from a list of words, where the
+// `KEY=value` words are environment variables and the other ones are the
+// shell with its options, e.g. `bash -o pipefail`. The entry is named after
+// the shell, or its variables. A custom name can be set with a `name:`
+// prefix.
+func ParseMatrixEntry(spec string) MatrixEntry {
+	entry := MatrixEntry{}
+	if i := strings.Index(spec, ":"); i >= 0 && !strings.ContainsAny(spec[:i], " =") {
+		entry.Name = spec[:i]
+		spec = spec[i+1:]
+	}
+
+	for _, word := range strings.Fields(spec) {
+		if len(entry.Shell) == 0 && strings.Contains(word, "=") {
+			entry.Env = append(entry.Env, word)
+		} else {
+			entry.Shell = append(entry.Shell, word)
+		}
+	}
+
+	if entry.Name == "" {
+		if len(entry.Shell) > 0 {
+			entry.Name = filepath.Base(entry.Shell[0])
+		} else {
+			entry.Name = strings.Join(entry.Env, " ")
+		}
+	}
+	return entry
 }
 
 func (c RunConfig) Context() map[string]interface{} {
@@ -68,101 +262,298 @@ func (c RunConfig) Context() map[string]interface{} {
 	}
 
 	context["working-dir"] = c.WorkingDir
+	context["matrix"] = c.matrix
+	if c.http != nil {
+		context["http"] = c.http.context()
+	}
 	return context
 }
 
 type RunReport struct {
 	FailedCount  int
 	UpdatedCount int
-	TotalCount   int
+	SkippedCount int
+	// Number of tests marked with `xfail` which failed as expected.
+	XFailCount int
+	TotalCount int
+}
+
+// PassedCount returns the number of tests which passed.
+func (r RunReport) PassedCount() int {
+	return r.TotalCount - r.FailedCount - r.SkippedCount - r.XFailCount
 }
 
 func RunSuite(suite TestSuiteNode, config RunConfig) (RunReport, error) {
+	entries := config.Matrix
+	if len(entries) == 0 {
+		entries = []MatrixEntry{{}}
+	}
+
 	report := RunReport{
-		TotalCount: len(suite.Tests),
+		TotalCount: len(suite.Tests) * len(entries),
 	}
 
+	strategy, err := fixture.ParseStrategy(config.FixtureStrategy)
+	if err != nil {
+		return report, err
+	}
+	if config.Update && len(config.Matrix) > 0 {
+		// Each matrix entry would overwrite the expectations of the others,
+		// including the templates varying with the entry.
+		return report, fmt.Errorf("the tests can't be updated when running a matrix")
+	}
+
+	hasOnly := false
 	for _, test := range suite.Tests {
-		wd, err := setupTempWorkingDir(test.Name, config.WorkingDir)
-		if err != nil {
-			return report, err
+		hasOnly = hasOnly || test.Only
+	}
+
+	for _, test := range suite.Tests {
+		if hasOnly && !test.Only && !test.Skip.Set {
+			test.Skip = Marker{Set: true, Reason: "not marked with `only`"}
 		}
-		defer os.RemoveAll(wd)
 
-		testConfig := config
-		testConfig.WorkingDir = wd
+		for _, entry := range entries {
+			test := test
+			testConfig := config
+			if len(config.Matrix) > 0 {
+				test.Name = fmt.Sprintf("%s [%s]", test.Name, entry.Name)
+				testConfig.matrix = entry.Name
+				if len(entry.Shell) > 0 {
+					testConfig.Shell = entry.Shell
+				}
+				testConfig.Env = append(append([]string{}, config.Env...), entry.Env...)
+			}
 
-		testConfig.Callbacks.OnFinishTest = func(test TestNode, err error) {
-			if config.Callbacks.OnFinishTest != nil {
-				config.Callbacks.OnFinishTest(test, err)
+			testConfig.Callbacks.OnFinishTest = func(test TestNode, err error) {
+				if config.Callbacks.OnFinishTest != nil {
+					config.Callbacks.OnFinishTest(test, err)
+				}
+				switch err.(type) {
+				case SkipError:
+					report.SkippedCount += 1
+				case XFailError:
+					report.XFailCount += 1
+				default:
+					if isFailure(err) {
+						report.FailedCount += 1
+					}
+				}
 			}
-			if err != nil {
-				report.FailedCount += 1
+
+			if !test.Skip.Set && len(test.Git) > 0 {
+				if reason := checkRequirements([]string{"git"}, testConfig); reason != "" {
+					test.Skip = Marker{Set: true, Reason: reason}
+				}
+			}
+			if test.Skip.Set {
+				_ = RunTest(test, testConfig)
+				continue
+			}
+
+			testConfig.Callbacks.OnUpdateTest = func(test TestNode) {
+				if config.Callbacks.OnUpdateTest != nil {
+					config.Callbacks.OnUpdateTest(test)
+				}
+				report.UpdatedCount += 1
 			}
-		}
 
-		testConfig.Callbacks.OnUpdateTest = func(test TestNode) {
-			if config.Callbacks.OnUpdateTest != nil {
-				config.Callbacks.OnUpdateTest(test)
+			result, err := runTestInTempDir(test, testConfig, strategy)
+			if err != nil {
+				return report, err
+			}
+			if _, ok := result.(DebugAbortError); ok {
+				return report, result
 			}
-			report.UpdatedCount += 1
 		}
-
-		_ = RunTest(test, testConfig)
 	}
 
 	return report, nil
 }
 
-func setupTempWorkingDir(name string, sourceDir string) (string, error) {
-	targetDir, err := ioutil.TempDir("", strings.ReplaceAll(name, "/", "-")+"-*")
+// runTestInTempDir runs the test from a new temporary working dir, in which
+// the fixtures are installed. It returns the result of the test, which is a
+// SetupError if the fixtures could not be installed, or an error if the
+// temporary dirs could not be created or removed.
+func runTestInTempDir(test TestNode, config RunConfig, strategy fixture.Strategy) (result error, err error) {
+	fixtures := append([]string{config.WorkingDir}, test.Fixtures...)
+
+	wd, err := createTempWorkingDir(test.Name)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	targetDir, err = paths.Canonical(targetDir)
+	config.WorkingDir = wd
+	config.tempDir = wd
+	stateDir, err := createTempWorkingDir(test.Name + "-state")
 	if err != nil {
-		return "", err
+		os.RemoveAll(wd)
+		return nil, err
+	}
+	config.stateDir = stateDir
+
+	keep := false
+	defer func() {
+		if keep {
+			return
+		}
+		if rmErr := os.RemoveAll(stateDir); err == nil {
+			err = rmErr
+		}
+		if rmErr := os.RemoveAll(wd); err == nil {
+			err = rmErr
+		}
+	}()
+
+	// A skipped test is not set up, as its fixtures might need the unmet
+	// requirements.
+	config.skipChecked = true
+	if result = checkSkip(test, config); result != nil {
+		if config.Callbacks.OnFinishTest != nil {
+			config.Callbacks.OnFinishTest(test, result)
+		}
+	} else if setupErr := setupTest(test, &config, fixtures, strategy); setupErr != nil {
+		// Only this test fails, the next ones can still run.
+		result = SetupError{Err: setupErr}
+		if test.XFail.Set {
+			result = XFailError{Reason: test.XFail.Reason, Err: result}
+		}
+		if config.Callbacks.OnFinishTest != nil {
+			config.Callbacks.OnFinishTest(test, result)
+		}
+	} else {
+		result = RunTest(test, config)
 	}
-	if sourceDir == "" {
-		return targetDir, nil
+	if config.http != nil {
+		config.http.stop()
 	}
 
-	err = filepath.Walk(sourceDir, func(sourcePath string, info os.FileInfo, err error) error {
-		if sourcePath == sourceDir {
-			return nil
+	if config.Keep == KeepAlways || (config.Keep == KeepOnFailure && isFailure(result)) {
+		keep = true
+		if config.Callbacks.OnKeepWorkingDir != nil {
+			config.Callbacks.OnKeepWorkingDir(test, wd)
 		}
+	}
+	return result, nil
+}
 
-		wrap := errors.Wrapperf("walk %s", sourcePath)
+// setupTest starts the HTTP servers of the test, and installs its fixtures
+// in the working dir of the config.
+func setupTest(test TestNode, config *RunConfig, fixtures []string, strategy fixture.Strategy) error {
+	// The servers are started first, for their URL to be available in the
+	// fixture templates.
+	if len(test.HTTP) > 0 {
+		servers, err := startHTTPServers(test.HTTP)
 		if err != nil {
-			return wrap(err)
+			return err
 		}
-		sourceName, err := filepath.Rel(sourceDir, sourcePath)
+		config.http = servers
+	}
+
+	if err := installFixtures(fixtures, strategy, *config); err != nil {
+		return err
+	}
+	if len(test.Git) > 0 {
+		env, err := setupGitRepo(test.Git, *config)
 		if err != nil {
-			return wrap(err)
+			return errors.Wrap(err, "git fixture")
 		}
-		targetPath := filepath.Join(targetDir, sourceName)
+		config.Env = append(env, config.Env...)
+	}
+	return nil
+}
 
-		if info.IsDir() {
-			return wrap(os.Mkdir(targetPath, os.ModePerm))
-		} else {
-			sourceData, err := ioutil.ReadFile(sourcePath)
-			if err != nil {
-				return wrap(err)
-			}
-			err = ioutil.WriteFile(targetPath, sourceData, os.ModePerm)
-			if err != nil {
-				return wrap(err)
-			}
-		}
-		return nil
-	})
+// isFailure returns whether the given test result is an actual failure.
+func isFailure(err error) bool {
+	switch err.(type) {
+	case nil, SkipError, XFailError:
+		return false
+	default:
+		return true
+	}
+}
 
-	return targetDir, err
+var unsafePathChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+func createTempWorkingDir(name string) (string, error) {
+	dir, err := ioutil.TempDir("", unsafePathChars.ReplaceAllString(name, "-")+"-*")
+	if err != nil {
+		return "", err
+	}
+	return paths.Canonical(dir)
+}
+
+// IsFixtureArchive returns whether the given path is an archive which can be
+// used as a fixture, instead of a directory.
+func IsFixtureArchive(path string) bool {
+	return fixture.IsArchive(path)
+}
+
+// installFixtures installs the given fixture directories or archives in the
+// working dir of the config, layered on top of each other. Templates are
+// rendered with the context of the config.
+func installFixtures(sources []string, strategy fixture.Strategy, config RunConfig) error {
+	installer := fixture.Installer{
+		Strategy: strategy,
+		Render: func(template string) (string, error) {
+			return expandString(template, config.Context())
+		},
+	}
+	for _, source := range sources {
+		if source == "" {
+			continue
+		}
+		if err := installer.Install(source, config.WorkingDir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func RunTest(test TestNode, config RunConfig) error {
 	callbacks := config.Callbacks
 
+	if !config.skipChecked {
+		if err := checkSkip(test, config); err != nil {
+			if callbacks.OnFinishTest != nil {
+				callbacks.OnFinishTest(test, err)
+			}
+			return err
+		}
+	}
+
+	if len(test.Shell) > 0 {
+		config.Shell = test.Shell
+	}
+	if test.Path != "" {
+		config.testDir = filepath.Dir(test.Path)
+	}
+	config.ignoredKeys = test.IgnoreKeys
+
+	if config.stateDir == "" {
+		stateDir, err := ioutil.TempDir("", "tesh-state-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(stateDir)
+		config.stateDir = stateDir
+	}
+	config.background = newBackgroundProcs()
+	defer config.background.stopAll()
+
+	if config.http == nil && len(test.HTTP) > 0 {
+		servers, err := startHTTPServers(test.HTTP)
+		if err != nil {
+			return err
+		}
+		defer servers.stop()
+		config.http = servers
+	}
+
+	// Expected failures are not updated, otherwise they would pass.
+	if test.XFail.Set {
+		config.Update = false
+	}
+
 	if callbacks.OnStartTest != nil {
 		callbacks.OnStartTest(test)
 	}
@@ -170,6 +561,13 @@ func RunTest(test TestNode, config RunConfig) error {
 	var err error
 	hasChanges := false
 
+	if err := installStubs(test.Stubs, &config); err != nil {
+		if callbacks.OnFinishTest != nil {
+			callbacks.OnFinishTest(test, err)
+		}
+		return err
+	}
+
 loop:
 	for _, node := range test.Children {
 		switch node := node.(type) {
@@ -178,14 +576,39 @@ loop:
 				callbacks.OnComment(test, node.Content)
 			}
 		case *CommandNode:
+			if err = installStubs(node.Stubs, &config); err != nil {
+				break loop
+			}
+			if node.Skip.Set {
+				if callbacks.OnSkipCommand != nil {
+					callbacks.OnSkipCommand(test, *node, node.Skip.Reason)
+				}
+				continue
+			}
+			if reason := checkRequirements(node.Requires, config); reason != "" {
+				err = SkipError{Reason: reason}
+				break loop
+			}
 			if callbacks.OnStartCommand != nil {
 				callbacks.OnStartCommand(test, *node, config)
 			}
+			cmdConfig := config
 			config.WorkingDir, err = runCmd(node, config, &hasChanges)
 			if callbacks.OnFinishCommand != nil {
 				callbacks.OnFinishCommand(test, *node, config, err)
 			}
 			if err != nil {
+				if config.Keep != KeepNever && config.tempDir != "" && !test.XFail.Set {
+					_ = writeReproScript(test, *node, cmdConfig)
+				}
+				if config.Debug && !test.XFail.Set {
+					if callbacks.OnDebugCommand != nil {
+						callbacks.OnDebugCommand(test, *node, cmdConfig)
+					}
+					if debugErr := runDebugShell(cmdConfig); debugErr != nil {
+						err = DebugAbortError{Err: err}
+					}
+				}
 				break loop
 			}
 		case SpacerNode:
@@ -194,6 +617,14 @@ loop:
 			panic(fmt.Sprintf("unknown test Node: %s", node.Dump()))
 		}
 	}
+
+	if _, skipped := err.(SkipError); test.XFail.Set && !skipped {
+		if err != nil {
+			err = XFailError{Reason: test.XFail.Reason, Err: err}
+		} else {
+			err = UnexpectedPassError{Reason: test.XFail.Reason}
+		}
+	}
 	if callbacks.OnFinishTest != nil {
 		callbacks.OnFinishTest(test, err)
 	}
@@ -211,120 +642,375 @@ loop:
 	return err
 }
 
+// checkSkip returns a SkipError if the test is skipped with the `skip`
+// directive, or if one of its requirements is not met.
+func checkSkip(test TestNode, config RunConfig) error {
+	if test.Skip.Set {
+		return SkipError{Reason: test.Skip.Reason}
+	}
+	// The shell of the test is also used to check the requirements.
+	if len(test.Shell) > 0 {
+		config.Shell = test.Shell
+	}
+	if reason := checkRequirements(test.Requires, config); reason != "" {
+		return SkipError{Reason: reason}
+	}
+	return nil
+}
+
+// writeReproScript writes a shell script reproducing the given command in
+// the temporary working dir of the test, with the same environment and
+// input.
+func writeReproScript(test TestNode, node CommandNode, config RunConfig) error {
+	node, err := expandNode(node, config.Context())
+	if err != nil {
+		return err
+	}
+
+	shell := config.Shell
+	if len(shell) == 0 {
+		shell = []string{executil.DefaultShell()}
+	}
+
+	script := "#!/bin/sh\n"
+	script += "# Reproduces the failed command of " + test.Name + "\n"
+	script += "cd " + executil.Quote(config.WorkingDir) + " || exit 1\n"
+	script += "exec env -i"
+	for _, variable := range commandEnv(config) {
+		script += " " + executil.Quote(variable)
+	}
+	for _, arg := range shell {
+		script += " " + executil.Quote(arg)
+	}
+	script += " -c " + executil.Quote(node.Cmd)
+
+	stdinPath := filepath.Join(config.tempDir, "tesh-repro.stdin")
+	if node.Stdin.IsEmpty() {
+		script += " < /dev/null\n"
+	} else {
+		script += " < " + executil.Quote(stdinPath) + "\n"
+		err = ioutil.WriteFile(stdinPath, []byte(handlebars.StripDelays(node.Stdin.Content)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(filepath.Join(config.tempDir, ReproScriptName), []byte(script), 0755)
+}
+
+// runDebugShell starts an interactive shell in the working dir of the
+// config, with the same environment as the commands.
+func runDebugShell(config RunConfig) error {
+	shell := debugShell(config.Shell)
+	cmd := exec.Command(shell[0], shell[1:]...)
+	cmd.Dir = config.WorkingDir
+	cmd.Env = append(commandEnv(config), "TERM="+os.Getenv("TERM"), "PS1=(tesh) $ ")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// debugShell returns the command line of the debug shell: the program of the
+// shell of the tests, without the options such as `-e` which would exit the
+// interactive shell on the first failure. A wrapper such as `/usr/bin/env`
+// is kept up to the program it runs, or replaced by $SHELL when it doesn't
+// name one.
+func debugShell(shell []string) []string {
+	if len(shell) == 0 {
+		return []string{executil.DefaultShell()}
+	}
+	if filepath.Base(shell[0]) == "env" {
+		for i, arg := range shell[1:] {
+			if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+				return shell[:i+2]
+			}
+		}
+		return []string{executil.DefaultShell()}
+	}
+	return shell[:1]
+}
+
 func runCmd(node *CommandNode, config RunConfig, hasChanges *bool) (string, error) {
 	if node.IsEmpty() {
 		return config.WorkingDir, fmt.Errorf("unexpected empty command")
 	}
+	if len(node.IgnoreKeys) > 0 {
+		config.ignoredKeys = append(append([]string{}, config.ignoredKeys...), node.IgnoreKeys...)
+	}
 
 	if strings.HasPrefix(node.Cmd, "cd ") {
 		path := strings.TrimPrefix(node.Cmd, "cd ")
 		path, err := expandString(path, config.Context())
 		return filepath.Join(config.WorkingDir, path), err
 
+	} else if node.Background != "" {
+		err := runBackgroundCmd(node, config)
+		return config.WorkingDir, err
+
+	} else if isBuiltinCmd(node.Cmd) {
+		err := runWithRetry(node, config, hasChanges, runBuiltinCmd)
+		return config.WorkingDir, err
+
 	} else {
-		err := runShellCmd(node, config, hasChanges)
+		err := runWithRetry(node, config, hasChanges, runShellCmd)
 		return config.WorkingDir, err
 	}
 }
 
+// cmdResult holds the outputs and exit code of a command.
+type cmdResult struct {
+	Stdout string
+	Stderr string
+	// Lines of the combined output, see CommandNode.Combined.
+	Combined string
+	ExitCode int
+}
+
 func runShellCmd(sourceNode *CommandNode, config RunConfig, hasChanges *bool) error {
 	node, err := expandNode(*sourceNode, config.Context())
 	if err != nil {
 		return err
 	}
 
-	cmd := executil.CommandFromString(node.Cmd)
+	cmd := executil.ShellCommand(config.Shell, node.Cmd)
 	cmd.Dir = config.WorkingDir
-	if !node.Stdin.IsEmpty() {
-		cmd.Stdin = strings.NewReader(node.Stdin.Content)
+	stdin, err := setStdin(cmd, node.Stdin.Content, node.StdinMode)
+	if err != nil {
+		return err
 	}
-	if config.WorkingDir != "" {
-		cmd.Env = []string{"PATH=" + config.WorkingDir + ":" + os.Getenv("PATH")}
+	cmd.Env = commandEnv(config)
+	if err := writeCmdEnv(cmd.Env, config); err != nil {
+		if stdin != nil {
+			stdin.close()
+		}
+		return err
+	}
+	var stdout, stderr syncBuffer
+	var combined combinedOutput
+	var capture *combinedCapture
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if !node.Combined.IsEmpty() {
+		capture, err = captureCombined(cmd, &stdout, &stderr, &combined)
+		if err != nil {
+			if stdin != nil {
+				stdin.close()
+			}
+			return err
+		}
+	}
+	if len(node.Signals) > 0 {
+		setProcessGroup(cmd)
 	}
-	var stdoutBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	var stderrBuf bytes.Buffer
-	cmd.Stderr = &stderrBuf
 
-	cmd.Env = append(cmd.Env, "RUNNING_TESH=1")
-	err = cmd.Run()
+	if err := cmd.Start(); err != nil {
+		if stdin != nil {
+			stdin.close()
+		}
+		if capture != nil {
+			capture.wait()
+		}
+		return err
+	}
+	done := make(chan struct{})
+	if stdin != nil {
+		stdin.start(done)
+	}
+	if len(node.Signals) > 0 {
+		go sendSignals(cmd, node.Signals, &stdout, &stderr, done)
+	}
+	err = cmd.Wait()
+	if capture != nil {
+		capture.wait()
+	}
+	close(done)
 
-	stderr := string(stderrBuf.Bytes())
-	// Sometimes some garbage \r is prepended to stdout/stderr.
-	stderr = strings.TrimLeft(stderr, "\r")
-	expectedStderr := node.Stderr.Dump()
-	matched, matchErr := matchString(stderr, expectedStderr)
-	if matchErr != nil {
-		return matchErr
+	result := cmdResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Combined: combined.String(),
+		ExitCode: exitStatus(err),
 	}
-	if !matched {
-		if config.Update {
-			sourceNode.Stderr.Content = stderr
-			*hasChanges = true
-		} else {
-			_, expected := expandRegexes(expectedStderr)
-			return DataAssertError{
-				FD:       Stderr,
-				Received: stderr,
-				Expected: expected,
-			}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return err
+	}
+
+	return assertResult(sourceNode, node, result, config, hasChanges)
+}
+
+// assertResult checks that the result of a command matches the expected
+// outputs and exit code of the expanded node. In update mode, the source
+// node is modified to match the result instead.
+func assertResult(sourceNode *CommandNode, node CommandNode, result cmdResult, config RunConfig, hasChanges *bool) error {
+	if !node.Combined.IsEmpty() {
+		err := assertData(Combined, &sourceNode.Combined, node.Combined, result.Combined, config, hasChanges)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Sometimes some garbage \r is prepended to stdout/stderr.
+		stderr := strings.TrimLeft(result.Stderr, "\r")
+		err := assertData(Stderr, &sourceNode.Stderr, node.Stderr, stderr, config, hasChanges)
+		if err != nil {
+			return err
+		}
+
+		stdout := strings.TrimLeft(result.Stdout, "\r")
+		err = assertData(Stdout, &sourceNode.Stdout, node.Stdout, stdout, config, hasChanges)
+		if err != nil {
+			return err
 		}
 	}
 
-	stdout := string(stdoutBuf.Bytes())
-	stdout = strings.TrimLeft(stdout, "\r")
-	expectedStdout := node.Stdout.Dump()
-	matched, matchErr = matchString(stdout, expectedStdout)
-	if matchErr != nil {
-		return matchErr
+	for i, file := range node.Files {
+		path := file.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.WorkingDir, path)
+		}
+		// A missing file is compared as an empty one, so that it can be
+		// retried or updated.
+		content, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("expected file %s: %w", file.Path, err)
+		}
+		err = assertData(File, &sourceNode.Files[i].Data, file.Data, string(content), config, hasChanges)
+		if assertErr, ok := err.(DataAssertError); ok {
+			assertErr.Path = file.Path
+			return assertErr
+		} else if err != nil {
+			return err
+		}
 	}
-	if !matched {
+
+	if result.ExitCode != node.ExitCode {
 		if config.Update {
-			sourceNode.Stdout.Content = stdout
+			sourceNode.ExitCode = result.ExitCode
 			*hasChanges = true
 		} else {
-			_, expected := expandRegexes(expectedStdout)
-			return DataAssertError{
-				FD:       Stdout,
-				Received: stdout,
-				Expected: expected,
+			return ExitCodeAssertError{
+				Received: result.ExitCode,
+				Expected: node.ExitCode,
 			}
 		}
 	}
 
-	if err != nil {
-		if err, ok := err.(*exec.ExitError); ok {
-			status := err.ExitCode()
-			if status != node.ExitCode {
-				if config.Update {
-					sourceNode.ExitCode = status
-					*hasChanges = true
-				} else {
-					return ExitCodeAssertError{
-						Received: status,
-						Expected: node.ExitCode,
-						Stderr:   string(err.Stderr),
-					}
-				}
-			}
-		} else {
+	return nil
+}
+
+// assertData checks that the data received on a stream matches the expected
+// data. In update mode, the source data is modified instead.
+func assertData(fd FD, sourceData *DataNode, expected DataNode, received string, config RunConfig, hasChanges *bool) error {
+	if expected.Golden != "" {
+		content, err := readGoldenFile(expected.Golden, config)
+		if err != nil {
 			return err
 		}
+		expected.Content = content
+	}
+
+	var matched bool
+	var mismatches []string
+	if expected.Encoding != NoEncoding {
+		// Binary data is compared as is.
+		matched = received == expected.Content
+	} else if expected.Format != NoFormat {
+		var err error
+		mismatches, err = compareStructured(expected.Format, expected.Content, received, config.ignoredKeys)
+		// In update mode, invalid expected data is replaced, such as a
+		// golden file which doesn't exist yet.
+		if err != nil && !config.Update {
+			return fmt.Errorf("%s: %w", fd, err)
+		}
+		matched = err == nil && len(mismatches) == 0
 	} else {
-		if node.ExitCode != 0 {
-			if config.Update {
-				sourceNode.ExitCode = 0
-				*hasChanges = true
-			} else {
-				return ExitCodeAssertError{
-					Received: 0,
-					Expected: node.ExitCode,
-				}
-			}
+		var err error
+		matched, err = matchString(received, expected.Dump())
+		if err != nil {
+			return err
 		}
 	}
+	if matched {
+		return nil
+	}
 
-	return nil
+	if config.Update {
+		*hasChanges = true
+		if expected.Golden != "" {
+			return writeGoldenFile(expected.Golden, expected.Format.format(received), config)
+		}
+		sourceData.Content = sourceData.Format.format(received)
+		if sourceData.Encoding == NoEncoding && sourceData.Format == NoFormat && !isText(received) {
+			sourceData.Encoding = Base64Encoding
+		}
+		return nil
+	}
+
+	if expected.Encoding != NoEncoding {
+		return DataAssertError{
+			FD:       fd,
+			Received: strings.Join(expected.Encoding.encode(received), "\n"),
+			Expected: strings.Join(expected.Encoding.encode(expected.Content), "\n"),
+		}
+	}
+	_, expectedContent := expandRegexes(expected.Dump())
+	if expected.Format != NoFormat {
+		expectedContent, _ = handlebars.ExpandRegexes(expected.Content)
+	}
+	return DataAssertError{
+		FD:         fd,
+		Received:   received,
+		Expected:   expectedContent,
+		Mismatches: mismatches,
+	}
+}
+
+// readGoldenFile returns the expanded content of a golden file, relative to
+// the test file. A missing golden file is empty in update mode, to be
+// created.
+func readGoldenFile(golden string, config RunConfig) (string, error) {
+	content, err := ioutil.ReadFile(goldenFilePath(golden, config))
+	if err != nil && !(config.Update && os.IsNotExist(err)) {
+		return "", fmt.Errorf("golden file %s: %w", golden, err)
+	}
+	expanded, err := expandString(string(content), config.Context())
+	if err != nil {
+		return "", fmt.Errorf("golden file %s: %w", golden, err)
+	}
+	return expanded, nil
+}
+
+func writeGoldenFile(golden string, content string, config RunConfig) error {
+	path := goldenFilePath(golden, config)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
+
+func goldenFilePath(golden string, config RunConfig) string {
+	if filepath.IsAbs(golden) {
+		return golden
+	}
+	return filepath.Join(config.testDir, golden)
+}
+
+// commandEnv returns the environment variables of the commands run with the
+// given config.
+func commandEnv(config RunConfig) []string {
+	env := []string{}
+	path := os.Getenv("PATH")
+	if config.WorkingDir != "" {
+		path = config.WorkingDir + ":" + path
+	}
+	if config.stubsDir != "" {
+		path = config.stubsDir + ":" + path
+	}
+	if path != os.Getenv("PATH") {
+		env = append(env, "PATH="+path)
+	}
+	env = append(env, "RUNNING_TESH=1")
+	return append(env, config.Env...)
 }
 
 func expandNode(node CommandNode, context map[string]interface{}) (CommandNode, error) {
@@ -333,21 +1019,50 @@ func expandNode(node CommandNode, context map[string]interface{}) (CommandNode,
 	if err != nil {
 		return node, err
 	}
-	node.Stdin.Content, err = expandString(node.Stdin.Content, context)
+	node.Stdin, err = expandData(node.Stdin, context)
+	if err != nil {
+		return node, err
+	}
+	node.Stdout, err = expandData(node.Stdout, context)
 	if err != nil {
 		return node, err
 	}
-	node.Stdout.Content, err = expandString(node.Stdout.Content, context)
+	node.Stderr, err = expandData(node.Stderr, context)
 	if err != nil {
 		return node, err
 	}
-	node.Stderr.Content, err = expandString(node.Stderr.Content, context)
+	node.Combined, err = expandData(node.Combined, context)
 	if err != nil {
 		return node, err
 	}
+	// The files are copied to keep the source node intact.
+	files := node.Files
+	node.Files = []FileOutput{}
+	for _, file := range files {
+		file.Path, err = expandString(file.Path, context)
+		if err != nil {
+			return node, err
+		}
+		file.Data, err = expandData(file.Data, context)
+		if err != nil {
+			return node, err
+		}
+		node.Files = append(node.Files, file)
+	}
 	return node, err
 }
 
+// expandData expands the templates of a text data block. Binary data is
+// kept as is.
+func expandData(data DataNode, context map[string]interface{}) (DataNode, error) {
+	if data.Encoding != NoEncoding {
+		return data, nil
+	}
+	var err error
+	data.Content, err = expandString(data.Content, context)
+	return data, err
+}
+
 func expandString(s string, context map[string]interface{}) (string, error) {
 	tpl, err := raymond.Parse(s)
 	if err != nil {
@@ -1,8 +1,15 @@
 package tesh
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
+	executil "github.com/mickael-menu/tesh/pkg/internal/util/exec"
 	"github.com/mickael-menu/tesh/pkg/internal/util/test/assert"
 )
 
@@ -155,6 +162,993 @@ $`,
 	})
 }
 
+func TestRunSkipTest(t *testing.T) {
+	testRunErr(t, `
+# skip: not ready
+
+$ exit 1
+`, SkipError{Reason: "not ready"})
+}
+
+func TestRunSkipCommand(t *testing.T) {
+	testRun(t, `
+# skip
+$ exit 1
+
+$ echo "hello"
+>hello
+`)
+}
+
+func TestRunXFail(t *testing.T) {
+	testRunErr(t, `
+# xfail: bug #42
+
+$ exit 1
+`, XFailError{
+		Reason: "bug #42",
+		Err:    ExitCodeAssertError{Expected: 0, Received: 1},
+	})
+
+	testRunErr(t, `
+# xfail
+$ exit 0
+`, UnexpectedPassError{})
+}
+
+func TestRunRequirementsMet(t *testing.T) {
+	testRun(t, `
+# requires: sh, $(test 1 -eq 1)
+
+# requires: cat
+$ echo "hello"
+>hello
+`)
+}
+
+func TestRunRequiresExecutable(t *testing.T) {
+	testRunErr(t, `
+# requires: sh tesh-not-found
+
+$ exit 1
+`, SkipError{Reason: "requires `tesh-not-found`: executable not found in PATH"})
+}
+
+func TestRunRequiresEnv(t *testing.T) {
+	testRunErr(t, `
+# requires: $TESH_NOT_FOUND
+
+$ exit 1
+`, SkipError{Reason: "requires `$TESH_NOT_FOUND`: environment variable not set"})
+}
+
+func TestRunRequiresShellCondition(t *testing.T) {
+	testRunErr(t, `
+$ echo "hello"
+>hello
+
+# requires: $(test 1 -eq 2)
+$ exit 1
+`, SkipError{Reason: "requires `$(test 1 -eq 2)`: exit status 1"})
+}
+
+func TestRunRequiresShellConditionWithTestShell(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("requires bash")
+	}
+	testRun(t, `#!bash
+# requires: $(test -n "$BASH_VERSION")
+
+$ echo "hello"
+>hello
+`)
+}
+
+func TestRunShell(t *testing.T) {
+	testRunConfig(t, `
+1$ false; echo "hello"
+`, RunConfig{Shell: []string{"sh", "-e"}})
+}
+
+func TestRunShellFromShebang(t *testing.T) {
+	testRun(t, `#!sh -e
+1$ false; echo "hello"
+`)
+
+	testRunConfig(t, `# shell: sh
+$ false; echo "hello"
+>hello
+`, RunConfig{Shell: []string{"sh", "-e"}})
+}
+
+func TestRunSuiteReport(t *testing.T) {
+	suite := TestSuiteNode{}
+	for _, content := range []string{
+		"$ exit 0",
+		"$ exit 1",
+		"# skip\n\n$ exit 1",
+		"# xfail\n$ exit 1",
+		"# xfail\n$ exit 0",
+	} {
+		test, err := ParseTest(content)
+		assert.Nil(t, err)
+		test.Name = "test"
+		suite.Tests = append(suite.Tests, test)
+	}
+
+	report, err := RunSuite(suite, testConfig(RunConfig{}))
+	assert.Nil(t, err)
+	assert.Equal(t, report, RunReport{
+		FailedCount:  2,
+		SkippedCount: 1,
+		XFailCount:   1,
+		TotalCount:   5,
+	})
+	assert.Equal(t, report.PassedCount(), 1)
+}
+
+func TestRunSuiteOnly(t *testing.T) {
+	suite := TestSuiteNode{}
+	for _, content := range []string{
+		"$ exit 1",
+		"# only\n$ exit 0",
+	} {
+		test, err := ParseTest(content)
+		assert.Nil(t, err)
+		test.Name = "test"
+		suite.Tests = append(suite.Tests, test)
+	}
+
+	report, err := RunSuite(suite, testConfig(RunConfig{}))
+	assert.Nil(t, err)
+	assert.Equal(t, report, RunReport{
+		SkippedCount: 1,
+		TotalCount:   2,
+	})
+}
+
+func TestRunSuiteMatrix(t *testing.T) {
+	test, err := ParseTest(`
+$ echo "$GREETING from {{matrix}}"
+>{{#if (eq matrix "fr")}}bonjour{{else}}hello{{/if}} from {{matrix}}
+`)
+	assert.Nil(t, err)
+	test.Name = "greet.tesh"
+
+	names := []string{}
+	report, err := RunSuite(TestSuiteNode{Tests: []TestNode{test}}, testConfig(RunConfig{
+		Matrix: []MatrixEntry{
+			ParseMatrixEntry("GREETING=hello"),
+			ParseMatrixEntry("fr: GREETING=bonjour sh -e"),
+		},
+		Callbacks: RunCallbacks{
+			OnFinishTest: func(test TestNode, err error) {
+				assert.Nil(t, err)
+				names = append(names, test.Name)
+			},
+		},
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, report, RunReport{TotalCount: 2})
+	assert.Equal(t, names, []string{"greet.tesh [GREETING=hello]", "greet.tesh [fr]"})
+}
+
+func TestRunSuiteMatrixUpdate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "greet.tesh")
+	content := `$ echo "$GREETING"
+>{{#if (eq matrix "fr")}}bonjour{{else}}hello{{/if}}
+`
+	writeFiles(t, dir, map[string]string{"greet.tesh": content})
+	test, err := ParseTestFile(path)
+	assert.Nil(t, err)
+	test.Path = path
+
+	_, err = RunSuite(TestSuiteNode{Tests: []TestNode{test}}, testConfig(RunConfig{
+		Update: true,
+		Matrix: []MatrixEntry{
+			ParseMatrixEntry("GREETING=hi"),
+			ParseMatrixEntry("fr: GREETING=salut"),
+		},
+	}))
+	assert.Err(t, err, "the tests can't be updated when running a matrix")
+
+	updated, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(updated), content)
+}
+
+func TestRunSuiteKeepOnFailure(t *testing.T) {
+	suite := TestSuiteNode{}
+	for _, content := range []string{
+		"$ echo 'passed' > out",
+		"$ echo 'failed' > out\n$ cat -n out\n<input\n>failed",
+	} {
+		test, err := ParseTest(content)
+		assert.Nil(t, err)
+		test.Name = "test"
+		suite.Tests = append(suite.Tests, test)
+	}
+
+	kept := []string{}
+	_, err := RunSuite(suite, testConfig(RunConfig{
+		Keep: KeepOnFailure,
+		Callbacks: RunCallbacks{
+			OnKeepWorkingDir: func(test TestNode, dir string) {
+				kept = append(kept, dir)
+			},
+		},
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, len(kept), 1)
+	defer os.RemoveAll(kept[0])
+
+	out, err := ioutil.ReadFile(filepath.Join(kept[0], "out"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(out), "failed\n")
+
+	out, err = exec.Command(filepath.Join(kept[0], ReproScriptName)).Output()
+	assert.Nil(t, err)
+	assert.Equal(t, string(out), "     1\tfailed\n")
+}
+
+func TestRunSuiteDebugAbort(t *testing.T) {
+	// Fake shell running the commands with sh, but aborting when started
+	// interactively.
+	shell := filepath.Join(t.TempDir(), "shell")
+	err := ioutil.WriteFile(shell, []byte("#!/bin/sh\n[ $# -eq 0 ] && exit 1\nexec sh \"$@\"\n"), 0755)
+	assert.Nil(t, err)
+
+	suite := TestSuiteNode{}
+	for _, content := range []string{"$ echo 'hello'", "$ exit 0"} {
+		test, err := ParseTest(content)
+		assert.Nil(t, err)
+		test.Name = "test"
+		suite.Tests = append(suite.Tests, test)
+	}
+
+	debugged := []string{}
+	report, err := RunSuite(suite, RunConfig{
+		Debug: true,
+		Shell: []string{shell},
+		Callbacks: RunCallbacks{
+			OnDebugCommand: func(test TestNode, cmd CommandNode, config RunConfig) {
+				debugged = append(debugged, cmd.Cmd)
+			},
+		},
+	})
+	assert.Equal(t, err, DebugAbortError{Err: DataAssertError{
+		FD:       Stdout,
+		Received: "hello\n",
+	}})
+	assert.Equal(t, report, RunReport{FailedCount: 1, TotalCount: 2})
+	assert.Equal(t, debugged, []string{"echo 'hello'"})
+}
+
+func TestRunStubs(t *testing.T) {
+	testRun(t, `# stub: open
+$ open https://example.com
+
+# stub: git stdout "On branch main\n" stderr "warning\n" exit 3
+3$ git status
+>On branch main
+2>warning
+
+# stub: editor run echo "editing $1"; cat
+$ editor file.md
+<hello
+>editing file.md
+>hello
+
+# The stubs apply to the following commands.
+3$ git status
+>On branch main
+2>warning
+
+# stub: git exit 0
+$ git status
+`)
+}
+
+func TestRunStubCalls(t *testing.T) {
+	testRunConfig(t, `# stub: editor stdin
+# stub: open run cat > /dev/null; exit 3
+$ tesh-calls
+
+$ mkdir notes
+$ cd notes
+3$ editor "my note.md"; echo "piped" | editor; FOO=bar open -a
+$ cd ..
+$ tesh-calls
+>editor 'my note.md'
+>  cwd: notes
+>editor
+>  cwd: notes
+>  stdin: piped
+>open -a
+>  cwd: notes
+>  env: FOO=bar
+
+$ tesh-calls editor
+>editor 'my note.md'
+>  cwd: notes
+>editor
+>  cwd: notes
+>  stdin: piped
+
+# git was never called.
+$ tesh-calls git
+`, RunConfig{WorkingDir: t.TempDir()})
+
+	// Stubs without the stdin option don't consume the input of the caller.
+	testRunConfig(t, `# stub: git
+# stub: upper run tr a-z A-Z
+$ printf 'a\nb\n' | while read l; do git add "$l"; done
+$ echo "hello" | upper
+>HELLO
+
+# stdin: keep-open
+$ git status
+$ tesh-calls
+>git add a
+>git add b
+>upper
+>git status
+`, RunConfig{WorkingDir: t.TempDir()})
+}
+
+func TestRunBackground(t *testing.T) {
+	testRunConfig(t, `# ready: line ^ready$
+&server$ echo "starting"; sleep 0.2; echo "ready"; echo "oops" >&2; while true; do sleep 0.05; done
+$ echo "foreground"
+>foreground
+
+143$ tesh-stop server
+>starting
+>ready
+2>oops
+
+# ready: file done within 5s
+&worker$ sleep 0.2; touch done; cat; exit 3
+<input
+$ ls
+>done
+
+3$ tesh-wait worker 5s
+>input
+
+# Processes still running are stopped at the end of the test.
+&forever$ sleep 60
+`, RunConfig{WorkingDir: t.TempDir()})
+}
+
+func TestRunBackgroundNotReady(t *testing.T) {
+	testRunConfigErr(t, `# ready: line ^ready$ within 200ms
+&server$ echo "starting"; sleep 60
+`, RunConfig{WorkingDir: t.TempDir()}, fmt.Errorf("background process server not ready after 200ms:\nstarting"))
+
+	testRunConfigErr(t, `# ready: line ^ready$
+&server$ echo "crashed" >&2; exit 2
+`, RunConfig{WorkingDir: t.TempDir()}, fmt.Errorf("background process server exited with code 2 before being ready:\ncrashed"))
+
+	testRunErrMsg(t, `$ tesh-stop server`, "tesh-stop: unknown background process: server")
+
+	testRunErrMsg(t, `&server$ sleep 0.1
+$ tesh-wait server 10ms`, "tesh-wait: background process server still running after 10ms")
+}
+
+func TestRunBackgroundReadyPort(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("requires python3")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	testRunConfig(t, fmt.Sprintf(`# ready: port %d
+&server$ exec python3 -m http.server --bind 127.0.0.1 %d
+$ python3 -c "import urllib.request; print(urllib.request.urlopen('http://127.0.0.1:%d').status)"
+>200
+`, port, port, port), RunConfig{WorkingDir: t.TempDir()})
+}
+
+func TestRunSignals(t *testing.T) {
+	testRun(t, `# Graceful shutdown.
+# signal: INT on ^ready$
+$ trap 'echo "shutting down"; exit 0' INT; echo "ready"; while true; do sleep 0.05; done
+>ready
+>shutting down
+
+# Terminated by a signal.
+# signal: TERM after 100ms
+143$ sleep 5
+
+# Escalation when the signal is ignored.
+# signal: INT after 100ms
+# signal: KILL after 100ms
+137$ trap '' INT; echo "ignoring"; while true; do sleep 0.05; done
+>ignoring
+
+# Each trigger matches the output written after the previous signal.
+# signal: INT on ^ready
+# signal: TERM on ^ready
+$ exec 2> /dev/null; trap 'echo "interrupted"; sleep 0.2 || echo "too early"; echo "ready again"' INT; trap 'echo "terminated"; exit 0' TERM; echo "ready"; while true; do sleep 0.05; done
+>ready
+>interrupted
+>ready again
+>terminated
+`)
+
+	testRunConfig(t, `# signal: INT on ^ready$
+&server$ trap 'echo "interrupted"; exit 4' INT; echo "ready"; while true; do sleep 0.05; done
+4$ tesh-wait server
+>ready
+>interrupted
+`, RunConfig{WorkingDir: t.TempDir()})
+}
+
+func TestRunRetry(t *testing.T) {
+	testRunConfig(t, `&worker$ sleep 0.2; echo "done" > status
+
+# retry: 5s every 20ms
+$ cat status
+>done
+
+# stub: notify
+&notifier$ sleep 0.2; notify "done"
+
+# retry: 5s every 20ms
+$ tesh-calls
+>notify done
+`, RunConfig{WorkingDir: t.TempDir()})
+
+	testRunErr(t, `# retry: 100ms every 20ms
+$ echo "pending"
+>done
+`, DataAssertError{
+		FD:       Stdout,
+		Received: "pending\n",
+		Expected: "done\n",
+	})
+}
+
+func TestRunStreamingStdin(t *testing.T) {
+	testRun(t, `# Input written after a delay.
+$ (sleep 0.1; echo "waiting") & read line; echo "got $line"; wait
+<{{delay "500ms"}}first
+>waiting
+>got first
+
+# Partial input.
+$ read a; echo "got $a"; read b; echo "got $b"
+<first
+<{{delay "100ms"}}second
+>got first
+>got second
+
+# Input kept open until the command exits.
+# stdin: keep-open
+# signal: TERM after 200ms
+143$ cat
+<line
+>line
+
+# Input closed after a delay.
+# stdin: keep-open 100ms
+$ cat; echo "closed"
+<line
+>line
+>closed
+`)
+
+	testRunErrMsg(t, `$ cat
+<{{delay "soon"}}line
+`, "invalid delay: `soon`")
+}
+
+func TestRunEncodedData(t *testing.T) {
+	testRun(t, `$ od -An -tx1 | tr -d ' '
+hex<00 ff 0a
+>00ff0a
+
+$ printf '\000\377'
+hex>00 ff
+
+$ printf 'hello' >&2
+2base64>aGVsbG8=
+`)
+
+	testRunErr(t, `$ printf '\000\377'
+hex>00 fe
+`, DataAssertError{
+		FD:       Stdout,
+		Received: "00 ff",
+		Expected: "00 fe",
+	})
+}
+
+func TestRunUpdateEncodedData(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "binary.tesh")
+	writeFiles(t, dir, map[string]string{
+		"binary.tesh": `$ printf '\000\001'
+
+$ printf 'hello\r\n'
+>hello
+
+$ printf 'text'
+hex>00
+`,
+	})
+
+	test, err := ParseTestFile(path)
+	assert.Nil(t, err)
+	test.Path = path
+	assert.Nil(t, RunTest(test, testConfig(RunConfig{Update: true})))
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), `$ printf '\000\001'
+base64> AAE=
+
+$ printf 'hello\r\n'
+base64> aGVsbG8NCg==
+
+$ printf 'text'
+hex> 74 65 78 74
+`)
+}
+
+func TestRunCombinedOutput(t *testing.T) {
+	testRunConfig(t, `$ for i in 1 2 3; do echo "result $i"; echo "warning $i" >&2; done
+&>result 1
+&2>warning 1
+&>result 2
+&2>warning 2
+&>result 3
+&2>warning 3
+
+# Interrupted lines.
+$ printf "progress"; echo "error" >&2; echo " done"
+&>progress\
+&2>error
+&> done
+
+1$ echo "before"; cat missing; echo "after"; exit 1
+&>before
+&2>cat: {{match ".*"}}missing{{match ".*"}}
+&>after
+
+$ echo "took 12ms" >&2
+&2>took {{match "\d+"}}ms
+
+&server$ echo "starting"; echo "failed" >&2; exit 1
+1$ tesh-wait server
+&>starting
+&2>failed
+`, RunConfig{WorkingDir: t.TempDir()})
+
+	testRunErr(t, `$ echo "out"; echo "err" >&2
+&2>err
+&>out
+`, DataAssertError{
+		FD:       Combined,
+		Received: "&>out\n&2>err\n",
+		Expected: "&2>err\n&>out\n",
+	})
+}
+
+func TestRenderCombinedOutput(t *testing.T) {
+	assert.Equal(t, renderCombinedOutput([]outputChunk{}), "")
+	assert.Equal(t, renderCombinedOutput([]outputChunk{
+		{FD: Stdout, Data: "one\ntw"},
+		{FD: Stdout, Data: "o\nthr"},
+		{FD: Stderr, Data: "warning\n\n"},
+		{FD: Stdout, Data: "ee"},
+	}), "&>one\n&>two\n&>thr\\\n&2>warning\n&2>\n&>ee\\\n")
+}
+
+func TestRunFileOutputs(t *testing.T) {
+	testRunConfig(t, `$ echo '{"id": 42, "tags": []}' > out.json; mkdir logs; echo "done" > logs/export.log
+[out.json]>{"id": {{match "\d+"}}, "tags": []}
+[logs/export.log]>done
+
+$ printf '\000' > data.bin
+[data.bin]hex>00
+
+$ echo "spaced" > "my file.txt"
+[my file.txt]>spaced
+`, RunConfig{WorkingDir: t.TempDir()})
+
+	testRunConfigErr(t, `$ echo "new" > out.txt
+[out.txt]>old
+`, RunConfig{WorkingDir: t.TempDir()}, DataAssertError{
+		FD:       File,
+		Path:     "out.txt",
+		Received: "new\n",
+		Expected: "old\n",
+	})
+
+	testRunConfigErr(t, `$ true
+[missing.txt]>content
+`, RunConfig{WorkingDir: t.TempDir()}, DataAssertError{
+		FD:       File,
+		Path:     "missing.txt",
+		Received: "",
+		Expected: "content\n",
+	})
+
+	// A file written after the command exited is waited for with a retry.
+	testRunConfig(t, `# retry: 5s every 20ms
+$ (sleep 0.2; echo "ok" > out.txt) > /dev/null 2>&1 &
+[out.txt]>ok
+`, RunConfig{WorkingDir: t.TempDir()})
+}
+
+func TestRunUpdateFileOutputs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "files.tesh")
+	writeFiles(t, dir, map[string]string{
+		"files.tesh": `$ echo "hello" > out.txt; printf '\000' > data.bin
+[out.txt]>old
+[data.bin]>old
+[missing.txt]>old
+`,
+	})
+
+	test, err := ParseTestFile(path)
+	assert.Nil(t, err)
+	test.Path = path
+	assert.Nil(t, RunTest(test, testConfig(RunConfig{Update: true, WorkingDir: t.TempDir()})))
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(content), `$ echo "hello" > out.txt; printf '\000' > data.bin
+[out.txt]>hello
+[data.bin]base64> AA==
+`)
+}
+
+func TestRunGoldenFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tests/list.tesh": `$ printf 'one\ntwo\nthree 3\n'
+>@golden/list.txt
+
+$ echo "new" > out.txt
+[out.txt]>@golden/out.txt
+`,
+		"tests/golden/list.txt": "one\ntwo\nthree {{match \"\\d\"}}\n",
+		"tests/golden/out.txt":  "old\n",
+	})
+
+	test, err := ParseTestFile(filepath.Join(dir, "tests/list.tesh"))
+	assert.Nil(t, err)
+	test.Path = filepath.Join(dir, "tests/list.tesh")
+	err = RunTest(test, testConfig(RunConfig{WorkingDir: t.TempDir()}))
+	assert.Equal(t, err, DataAssertError{
+		FD:       File,
+		Path:     "out.txt",
+		Received: "new\n",
+		Expected: "old\n",
+	})
+
+	test, err = ParseTest("$ echo hello\n>@missing.txt\n")
+	assert.Nil(t, err)
+	err = RunTest(test, testConfig(RunConfig{}))
+	assert.Err(t, err, "golden file missing.txt: open ")
+}
+
+func TestRunUpdateGoldenFiles(t *testing.T) {
+	dir := t.TempDir()
+	script := `$ printf 'one\ntwo\n'
+>@golden/list.txt
+
+$ echo "error" >&2
+2>@golden/new/error.txt
+
+$ echo '{"id": 1}'
+json>@golden/item.json
+`
+	writeFiles(t, dir, map[string]string{
+		"list.tesh":       script,
+		"golden/list.txt": "one\n",
+	})
+
+	path := filepath.Join(dir, "list.tesh")
+	test, err := ParseTestFile(path)
+	assert.Nil(t, err)
+	test.Path = path
+	assert.Nil(t, RunTest(test, testConfig(RunConfig{Update: true})))
+
+	for path, expected := range map[string]string{
+		"list.tesh":            script,
+		"golden/list.txt":      "one\ntwo\n",
+		"golden/new/error.txt": "error\n",
+		"golden/item.json":     "{\n  \"id\": 1\n}\n",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, path))
+		assert.Nil(t, err)
+		assert.Equal(t, string(content), expected)
+	}
+}
+
+func TestRunStructuredData(t *testing.T) {
+	testRun(t, `# ignore-keys: $.items[*].id
+$ echo '{"total": 2, "items": [{"id": 1, "title": "a"}, {"id": 2, "title": "b"}], "took": 12}'
+json>{
+json>  "items": [{"title": "a"}, {"title": "b"}],
+json>  "took": "{{match "\d+"}}",
+json>  "total": 2.0
+json>}
+
+# ignore-keys: created_at
+$ echo '{"id": 1, "created_at": "2021-01-01"}' >&2
+2json>{"id": 1}
+`)
+
+	testRunErr(t, `$ echo '{"items": [{"title": "b"}, {"title": "c"}], "count": "2", "extra": true}'
+json>{"items": [{"title": "a"}], "count": 2}
+`, DataAssertError{
+		FD:       Stdout,
+		Received: `{"items": [{"title": "b"}, {"title": "c"}], "count": "2", "extra": true}` + "\n",
+		Expected: `{"items": [{"title": "a"}], "count": 2}` + "\n",
+		Mismatches: []string{
+			`$.count: expected 2 got "2"`,
+			`$.extra: unexpected true`,
+			`$.items[0].title: expected "a" got "b"`,
+			`$.items[1]: unexpected {"title":"c"}`,
+		},
+	})
+
+	testRunErr(t, `$ echo "not json"
+json>{}
+`, DataAssertError{
+		FD:         Stdout,
+		Received:   "not json\n",
+		Expected:   "{}\n",
+		Mismatches: []string{"$: invalid json: invalid character 'o' in literal null (expecting 'u')"},
+	})
+
+	testRunErrMsg(t, `$ echo "{}"
+json>{
+`, "stdout: invalid expected json: unexpected EOF")
+
+	testRunConfig(t, `$ printf 'took: 12\nname: tesh\n' > config.yml; printf 'name,took\ntesh,12\n'
+csv>took,name
+csv>{{match "\d+"}},tesh
+[config.yml]yaml>name: tesh
+[config.yml]yaml>took: {{match "\d+"}}
+`, RunConfig{WorkingDir: t.TempDir()})
+}
+
+func TestRunSuiteFixtures(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"wd/global":                     "global\n",
+		"wd/config.tpl":                 "dir: {{working-dir}}\n",
+		"wd/overridden":                 "global\n",
+		"tests/shared/shared":           "shared\n",
+		"tests/shared/overridden":       "shared\n",
+		"tests/foo.fixtures/local":      "local\n",
+		"tests/foo.fixtures/overridden": "local\n",
+		// Tests found in fixture directories are ignored.
+		"tests/foo.fixtures/ignored.tesh": "$ exit 1",
+		"tests/foo.tesh": `# fixtures: shared
+$ cat global shared local overridden
+>global
+>shared
+>local
+>local
+
+$ cat config
+>dir: {{working-dir}}
+`,
+	})
+
+	suite, err := ParseSuite(filepath.Join(dir, "tests"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(suite.Tests), 1)
+	assert.Equal(t, suite.Tests[0].Fixtures, []string{
+		filepath.Join(dir, "tests/shared"),
+		filepath.Join(dir, "tests/foo.fixtures"),
+	})
+
+	report, err := RunSuite(suite, testConfig(RunConfig{
+		WorkingDir: filepath.Join(dir, "wd"),
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, report, RunReport{TotalCount: 1})
+}
+
+func TestRunSuiteFixtureArchives(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"wd.txtar": "-- global --\nglobal\n-- overridden --\nglobal\n",
+		"tests/shared.txtar": `-- overridden --
+shared
+-- config.tpl --
+dir: {{working-dir}}
+`,
+		"tests/foo.tesh": `# fixtures: shared.txtar
+$ cat global overridden
+>global
+>shared
+
+$ cat config
+>dir: {{working-dir}}
+`,
+	})
+
+	suite, err := ParseSuite(filepath.Join(dir, "tests"))
+	assert.Nil(t, err)
+	report, err := RunSuite(suite, testConfig(RunConfig{
+		WorkingDir: filepath.Join(dir, "wd.txtar"),
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, report, RunReport{TotalCount: 1})
+}
+
+func TestRunSuiteGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("requires git")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tests/foo.tesh": `# git: file README.md "Hello\n"
+# git: commit Initial commit
+# git: tag v1.0 First release
+# git: branch feature
+# git: file docs/guide.md "Guide\n"
+# git: rm README.md
+# git: commit "Add the guide"
+# git: checkout main
+# git: merge feature
+$ git log --format='%h %p %an %ad %s' --date=iso
+>1d5105f 41b6814 5a6297c tesh 2000-01-01 00:04:00 +0000 Merge branch 'feature'
+>5a6297c 41b6814 tesh 2000-01-01 00:03:00 +0000 Add the guide
+>41b6814  tesh 2000-01-01 00:01:00 +0000 Initial commit
+
+$ git tag -n
+>v1.0            First release
+
+$ ls
+>docs
+
+$ git commit -q --allow-empty -m "From the test"
+$ git log -1 --format='%h %ae %ad' --date=iso
+>608c4c8 tesh@example.com 2000-01-01 00:05:00 +0000
+`,
+	})
+
+	suite, err := ParseSuite(filepath.Join(dir, "tests"))
+	assert.Nil(t, err)
+	report, err := RunSuite(suite, testConfig(RunConfig{}))
+	assert.Nil(t, err)
+	assert.Equal(t, report, RunReport{TotalCount: 1})
+}
+
+func TestRunSuiteSetupError(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tests/broken.tesh": "# http: api routes missing.json\n$ echo 'not run'\n",
+		"tests/ok.tesh":     "$ echo 'run'\n>run\n",
+		// Skipped tests are not set up.
+		"tests/skipped.tesh":  "# skip\n# http: api routes missing.json\n\n$ echo 'not run'\n",
+		"tests/requires.tesh": "# requires: tesh-not-found\n# http: api routes missing.json\n\n$ echo 'not run'\n",
+		"tests/xfail.tesh":    "# xfail: no routes yet\n# http: api routes missing.json\n\n$ echo 'not run'\n",
+	})
+
+	suite, err := ParseSuite(filepath.Join(dir, "tests"))
+	assert.Nil(t, err)
+	results := map[string]error{}
+	report, err := RunSuite(suite, testConfig(RunConfig{
+		Callbacks: RunCallbacks{
+			OnFinishTest: func(test TestNode, err error) {
+				results[test.Name] = err
+			},
+		},
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, report, RunReport{FailedCount: 1, SkippedCount: 2, XFailCount: 1, TotalCount: 5})
+	assert.Err(t, results["broken.tesh"], "setup failed: open ")
+	assert.Nil(t, results["ok.tesh"])
+	assert.Equal(t, results["skipped.tesh"], SkipError{})
+	assert.Equal(t, results["requires.tesh"], SkipError{Reason: "requires `tesh-not-found`: executable not found in PATH"})
+	assert.Err(t, results["xfail.tesh"], "expected failure (no routes yet): setup failed: open ")
+}
+
+func TestRunSuiteHTTP(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("requires curl")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tests/foo.fixtures/config.tpl": "url: {{http.api}}\n",
+		"tests/routes.json": `[
+	{"method": "post", "path": "/notes", "status": 201, "body": {"id": 1}, "headers": {"X-Id": "1"}},
+	{"path": "/text", "body": "hello\n"}
+]`,
+		"tests/foo.tesh": `# http: api GET /notes 200 body "[]\n" header "Content-Type: application/json"
+# http: api routes routes.json
+$ cat config
+>url: {{http.api}}
+
+$ curl -s -i {{http.api}}/notes | tr -d '\r' | grep -i "^content-type"
+>Content-Type: application/json
+
+$ curl -s -D - -d 'title=Hello' {{http.api}}/notes | tr -d '\r' | grep -i "^x-id\|^HTTP\|id"
+>HTTP/1.1 201 Created
+>X-Id: 1
+>{"id": 1}
+
+$ curl -s -H "Authorization: Bearer token" {{http.api}}/text?lang=en
+>hello
+
+$ curl -s {{http.api}}/unknown
+>no route for GET /unknown
+
+$ tesh-requests -H Authorization api
+>GET /notes
+>POST /notes
+>  body: title=Hello
+>GET /text?lang=en
+>  Authorization: Bearer token
+>GET /unknown
+`,
+	})
+
+	suite, err := ParseSuite(filepath.Join(dir, "tests"))
+	assert.Nil(t, err)
+	report, err := RunSuite(suite, testConfig(RunConfig{}))
+	assert.Nil(t, err)
+	assert.Equal(t, report, RunReport{TotalCount: 1})
+}
+
+func TestRunBuiltinShellSyntax(t *testing.T) {
+	for _, cmd := range []string{"tesh-calls | wc -l", "tesh-requests > out", "tesh-calls $STUB", "tesh-calls; echo", "tesh-calls|wc -l"} {
+		test, err := ParseTest("$ " + cmd + "\n")
+		assert.Nil(t, err)
+		err = RunTest(test, testConfig(RunConfig{WorkingDir: t.TempDir()}))
+		assert.Err(t, err, "unexpected shell syntax in `"+cmd+"`, builtin commands are not run by the shell")
+	}
+}
+
+func TestDebugShell(t *testing.T) {
+	defaultShell := executil.DefaultShell()
+	assert.Equal(t, debugShell(nil), []string{defaultShell})
+	assert.Equal(t, debugShell([]string{"bash", "-e"}), []string{"bash"})
+	assert.Equal(t, debugShell([]string{"/bin/zsh", "-o", "errexit"}), []string{"/bin/zsh"})
+	assert.Equal(t, debugShell([]string{"/usr/bin/env", "bash"}), []string{"/usr/bin/env", "bash"})
+	assert.Equal(t, debugShell([]string{"/usr/bin/env", "bash", "-e"}), []string{"/usr/bin/env", "bash"})
+	assert.Equal(t, debugShell([]string{"/usr/bin/env", "-i", "LANG=C", "dash"}), []string{"/usr/bin/env", "-i", "LANG=C", "dash"})
+	assert.Equal(t, debugShell([]string{"/usr/bin/env"}), []string{defaultShell})
+	assert.Equal(t, debugShell([]string{"env", "LANG=C"}), []string{defaultShell})
+}
+
+func TestParseMatrixEntry(t *testing.T) {
+	assert.Equal(t, ParseMatrixEntry("bash"), MatrixEntry{
+		Name:  "bash",
+		Shell: []string{"bash"},
+	})
+	assert.Equal(t, ParseMatrixEntry("/bin/zsh -o pipefail"), MatrixEntry{
+		Name:  "zsh",
+		Shell: []string{"/bin/zsh", "-o", "pipefail"},
+	})
+	assert.Equal(t, ParseMatrixEntry("A=1 B=2"), MatrixEntry{
+		Name: "A=1 B=2",
+		Env:  []string{"A=1", "B=2"},
+	})
+	assert.Equal(t, ParseMatrixEntry("legacy: LEGACY=1 PATH=/bin:/usr/bin dash -e"), MatrixEntry{
+		Name:  "legacy",
+		Shell: []string{"dash", "-e"},
+		Env:   []string{"LEGACY=1", "PATH=/bin:/usr/bin"},
+	})
+}
+
 func testRun(t *testing.T, content string) {
 	testRunConfig(t, content, RunConfig{})
 }
@@ -162,13 +1156,40 @@ func testRun(t *testing.T, content string) {
 func testRunConfig(t *testing.T, content string, config RunConfig) {
 	test, err := ParseTest(content)
 	assert.Nil(t, err)
-	err = RunTest(test, config)
+	err = RunTest(test, testConfig(config))
 	assert.Nil(t, err)
 }
 
 func testRunErr(t *testing.T, content string, expected error) {
+	testRunConfigErr(t, content, RunConfig{}, expected)
+}
+
+func testRunErrMsg(t *testing.T, content string, msg string) {
+	test, err := ParseTest(content)
+	assert.Nil(t, err)
+	err = RunTest(test, testConfig(RunConfig{}))
+	assert.Err(t, err, msg)
+}
+
+func testRunConfigErr(t *testing.T, content string, config RunConfig, expected error) {
 	test, err := ParseTest(content)
 	assert.Nil(t, err)
-	err = RunTest(test, RunConfig{})
+	err = RunTest(test, testConfig(config))
 	assert.Equal(t, err, expected)
 }
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+// testConfig prevents the tests from depending on the user's $SHELL.
+func testConfig(config RunConfig) RunConfig {
+	if len(config.Shell) == 0 {
+		config.Shell = []string{"sh"}
+	}
+	return config
+}
@@ -0,0 +1,93 @@
+package tesh
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SignalTrigger sends a signal to a running command, declared with the
+// `signal` directive, e.g. `# signal: INT after 500ms` or
+// `# signal: TERM on ^Listening`.
+type SignalTrigger struct {
+	// Name of the signal, without the SIG prefix, e.g. INT.
+	Signal string
+	// Delay before sending the signal.
+	After time.Duration
+	// Regular expression matching a line of the output, which triggers the
+	// signal when printed.
+	On string
+}
+
+// parseSignalTrigger parses the arguments of a `signal` directive:
+// `<signal> after <duration>` or `<signal> on <regex>`.
+func parseSignalTrigger(args string) (SignalTrigger, error) {
+	trigger := SignalTrigger{}
+	parts := strings.SplitN(strings.TrimSpace(args), " ", 3)
+	if len(parts) < 3 || strings.TrimSpace(parts[2]) == "" {
+		return trigger, fmt.Errorf("expected `<signal> after <duration>` or `<signal> on <regex>`")
+	}
+
+	trigger.Signal = strings.TrimPrefix(strings.ToUpper(parts[0]), "SIG")
+	if _, ok := signalsByName[trigger.Signal]; !ok {
+		return trigger, fmt.Errorf("unsupported signal: `%s`", parts[0])
+	}
+
+	value := strings.TrimSpace(parts[2])
+	switch parts[1] {
+	case "after":
+		delay, err := time.ParseDuration(value)
+		if err != nil {
+			return trigger, fmt.Errorf("invalid duration: %w", err)
+		}
+		trigger.After = delay
+	case "on":
+		if _, err := regexp.Compile(value); err != nil {
+			return trigger, err
+		}
+		trigger.On = value
+	default:
+		return trigger, fmt.Errorf("expected `after` or `on`, got `%s`", parts[1])
+	}
+	return trigger, nil
+}
+
+// sendSignals sends the signals of the triggers to the process group of the
+// running command, in order. Each trigger waits for the previous signal to be
+// sent, and only matches the output written after it. It stops when the done
+// channel is closed.
+func sendSignals(cmd *exec.Cmd, triggers []SignalTrigger, stdout, stderr *syncBuffer, done <-chan struct{}) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	// Length of the outputs when the previous signal was sent.
+	stdoutStart, stderrStart := 0, 0
+	for _, trigger := range triggers {
+		var after <-chan time.Time
+		var onRegex *regexp.Regexp
+		if trigger.On != "" {
+			onRegex = regexp.MustCompile("(?m)" + trigger.On)
+		} else {
+			after = time.After(trigger.After)
+		}
+
+	wait:
+		for {
+			select {
+			case <-done:
+				return
+			case <-after:
+				break wait
+			case <-ticker.C:
+				if onRegex != nil && (onRegex.MatchString(stdout.String()[stdoutStart:]) || onRegex.MatchString(stderr.String()[stderrStart:])) {
+					break wait
+				}
+			}
+		}
+
+		stdoutStart, stderrStart = len(stdout.String()), len(stderr.String())
+		signalProcessGroup(cmd, signalsByName[trigger.Signal])
+	}
+}
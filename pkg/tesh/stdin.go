@@ -0,0 +1,127 @@
+package tesh
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mickael-menu/tesh/pkg/internal/handlebars"
+)
+
+// StdinMode tells when the standard input of a command is closed, declared
+// with the `stdin` directive, e.g. `# stdin: keep-open` or
+// `# stdin: keep-open 2s`.
+type StdinMode struct {
+	// Keeps stdin open after writing the input, instead of closing it.
+	KeepOpen bool
+	// Duration stdin is kept open after writing the input. Zero keeps it
+	// open until the command exits.
+	KeepOpenFor time.Duration
+}
+
+// parseStdinMode parses the arguments of a `stdin` directive:
+// `keep-open [<duration>]`.
+func parseStdinMode(args string) (StdinMode, error) {
+	mode := StdinMode{}
+	parts := strings.Fields(args)
+	if len(parts) == 0 || len(parts) > 2 || parts[0] != "keep-open" {
+		return mode, fmt.Errorf("expected `keep-open [<duration>]`")
+	}
+	mode.KeepOpen = true
+	if len(parts) == 2 {
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil || duration <= 0 {
+			return mode, fmt.Errorf("invalid duration: `%s`", parts[1])
+		}
+		mode.KeepOpenFor = duration
+	}
+	return mode, nil
+}
+
+// stdinStream writes the standard input of a running command through a pipe,
+// pausing at the {{delay}} markers and closing it according to the stdin
+// mode.
+type stdinStream struct {
+	reader *os.File
+	writer *os.File
+	chunks []handlebars.Chunk
+	mode   StdinMode
+}
+
+// setStdin connects the given input to the stdin of the command. A stream is
+// returned when the input needs to be written while the command is running,
+// to be started with the command.
+func setStdin(cmd *exec.Cmd, content string, mode StdinMode) (*stdinStream, error) {
+	chunks := handlebars.SplitDelays(content)
+	isDelayed := false
+	for _, chunk := range chunks {
+		isDelayed = isDelayed || chunk.Delay > 0
+	}
+
+	if !isDelayed && !mode.KeepOpen {
+		if content != "" {
+			cmd.Stdin = strings.NewReader(content)
+		}
+		return nil, nil
+	}
+
+	// Using an *os.File rather than an io.Reader prevents cmd.Wait() from
+	// waiting for the end of the input, when it is kept open.
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = reader
+	return &stdinStream{
+		reader: reader,
+		writer: writer,
+		chunks: chunks,
+		mode:   mode,
+	}, nil
+}
+
+// start writes the input in the background, once the command is started.
+// Writing stops when the done channel is closed.
+func (s *stdinStream) start(done <-chan struct{}) {
+	// The command has its own copy of the read end.
+	s.reader.Close()
+	go s.write(done)
+}
+
+// close releases the pipe, when the command could not be started.
+func (s *stdinStream) close() {
+	s.reader.Close()
+	s.writer.Close()
+}
+
+func (s *stdinStream) write(done <-chan struct{}) {
+	defer s.writer.Close()
+
+	for _, chunk := range s.chunks {
+		if chunk.Delay > 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(chunk.Delay):
+			}
+		}
+		if _, err := io.WriteString(s.writer, chunk.Content); err != nil {
+			// The command exited or closed its stdin.
+			return
+		}
+	}
+
+	if s.mode.KeepOpen {
+		var after <-chan time.Time
+		if s.mode.KeepOpenFor > 0 {
+			after = time.After(s.mode.KeepOpenFor)
+		}
+		select {
+		case <-done:
+		case <-after:
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package tesh
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mickael-menu/tesh/pkg/internal/handlebars"
+	"gopkg.in/yaml.v2"
+)
+
+// Format of a data block compared structurally rather than as text. It is
+// written before the stream symbol of the data lines, e.g. `json>`.
+type Format string
+
+const (
+	NoFormat   Format = ""
+	JSONFormat Format = "json"
+	YAMLFormat Format = "yaml"
+	TOMLFormat Format = "toml"
+	// CSV and TSV data must start with a header row. Each row is compared as
+	// an object keyed by the column names, so the order of the columns
+	// doesn't matter.
+	CSVFormat Format = "csv"
+	TSVFormat Format = "tsv"
+	// CSV and TSV data without a header row. Each row is compared as an
+	// array of values, by position.
+	CSVNoHeaderFormat Format = "csv-noheader"
+	TSVNoHeaderFormat Format = "tsv-noheader"
+)
+
+var formats = map[string]Format{
+	"json":         JSONFormat,
+	"yaml":         YAMLFormat,
+	"toml":         TOMLFormat,
+	"csv":          CSVFormat,
+	"tsv":          TSVFormat,
+	"csv-noheader": CSVNoHeaderFormat,
+	"tsv-noheader": TSVNoHeaderFormat,
+}
+
+// parse returns the structured value of the given data, made of
+// map[string]interface{}, []interface{} and scalar values.
+func (f Format) parse(data string) (interface{}, error) {
+	switch f {
+	case JSONFormat:
+		decoder := json.NewDecoder(strings.NewReader(data))
+		// Keeps the numbers as written, to print them in the diffs.
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		if decoder.More() {
+			return nil, fmt.Errorf("unexpected data after the JSON value")
+		}
+		return value, nil
+	case YAMLFormat:
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(data), &value); err != nil {
+			return nil, err
+		}
+		return normalizeValue(value), nil
+	case TOMLFormat:
+		value := map[string]interface{}{}
+		if _, err := toml.Decode(data, &value); err != nil {
+			return nil, err
+		}
+		return normalizeValue(value), nil
+	case CSVFormat:
+		return parseCSV(data, ',', true)
+	case TSVFormat:
+		return parseCSV(data, '\t', true)
+	case CSVNoHeaderFormat:
+		return parseCSV(data, ',', false)
+	case TSVNoHeaderFormat:
+		return parseCSV(data, '\t', false)
+	default:
+		panic(fmt.Sprintf("unknown format: %s", f))
+	}
+}
+
+// normalizeValue converts the values decoded from YAML and TOML to the types
+// used for JSON, to compare them the same way.
+func normalizeValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		object := map[string]interface{}{}
+		for key, item := range value {
+			object[fmt.Sprint(key)] = normalizeValue(item)
+		}
+		return object
+	case map[string]interface{}:
+		object := map[string]interface{}{}
+		for key, item := range value {
+			object[key] = normalizeValue(item)
+		}
+		return object
+	case []interface{}:
+		array := []interface{}{}
+		for _, item := range value {
+			array = append(array, normalizeValue(item))
+		}
+		return array
+	case []map[string]interface{}:
+		array := []interface{}{}
+		for _, item := range value {
+			array = append(array, normalizeValue(item))
+		}
+		return array
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	default:
+		return value
+	}
+}
+
+// parseCSV returns the rows of the given CSV data, as objects keyed by the
+// column names of the header row, or as arrays of values without a header.
+// The values are trimmed.
+func parseCSV(data string, separator rune, hasHeader bool) (interface{}, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.Comma = separator
+	if separator == '\t' {
+		reader.LazyQuotes = true
+	} else {
+		// Trimming the leading spaces with a tab separator would also trim
+		// the tabs of empty values.
+		reader.TrimLeadingSpace = true
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+	}
+
+	rows := []interface{}{}
+	if !hasHeader {
+		for _, record := range records {
+			row := []interface{}{}
+			for _, value := range record {
+				row = append(row, value)
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("expected a header row")
+	}
+	header := records[0]
+	columns := map[string]bool{}
+	for _, name := range header {
+		if columns[name] {
+			return nil, fmt.Errorf("duplicate column: `%s`", name)
+		}
+		columns[name] = true
+	}
+	for _, record := range records[1:] {
+		row := map[string]interface{}{}
+		for i, value := range record {
+			row[header[i]] = value
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// format returns the received data as it should be written in an updated
+// data block.
+func (f Format) format(data string) string {
+	if f == JSONFormat {
+		var out bytes.Buffer
+		if err := json.Indent(&out, []byte(strings.TrimSpace(data)), "", "  "); err == nil {
+			return out.String() + "\n"
+		}
+	}
+	return data
+}
+
+// compareStructured compares the received data with the expected data of the
+// given format, and returns a description of the mismatches, prefixed with
+// their path in the data, e.g. `$.items[3].title: expected "a" got "b"`.
+func compareStructured(format Format, expected string, received string, ignoredKeys []string) ([]string, error) {
+	expectedValue, err := format.parse(expected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expected %s: %w", format, err)
+	}
+	receivedValue, err := format.parse(received)
+	if err != nil {
+		return []string{fmt.Sprintf("$: invalid %s: %s", format, err)}, nil
+	}
+
+	ignored, err := compileIgnoredKeys(ignoredKeys)
+	if err != nil {
+		return nil, err
+	}
+	return compareValues("$", expectedValue, receivedValue, ignored), nil
+}
+
+func compareValues(path string, expected interface{}, received interface{}, ignored []*regexp.Regexp) []string {
+	switch expected := expected.(type) {
+	case map[string]interface{}:
+		receivedObject, ok := received.(map[string]interface{})
+		if !ok {
+			return []string{mismatch(path, expected, received)}
+		}
+		return compareObjects(path, expected, receivedObject, ignored)
+
+	case []interface{}:
+		receivedArray, ok := received.([]interface{})
+		if !ok {
+			return []string{mismatch(path, expected, received)}
+		}
+		mismatches := []string{}
+		for i := 0; i < len(expected) || i < len(receivedArray); i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			if i >= len(receivedArray) {
+				mismatches = append(mismatches, fmt.Sprintf("%s: expected %s got nothing", itemPath, formatValue(expected[i])))
+			} else if i >= len(expected) {
+				mismatches = append(mismatches, fmt.Sprintf("%s: unexpected %s", itemPath, formatValue(receivedArray[i])))
+			} else {
+				mismatches = append(mismatches, compareValues(itemPath, expected[i], receivedArray[i], ignored)...)
+			}
+		}
+		return mismatches
+
+	default:
+		if !matchScalar(expected, received) {
+			return []string{mismatch(path, expected, received)}
+		}
+		return nil
+	}
+}
+
+func compareObjects(path string, expected map[string]interface{}, received map[string]interface{}, ignored []*regexp.Regexp) []string {
+	keys := []string{}
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	for key := range received {
+		if _, ok := expected[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	mismatches := []string{}
+	for _, key := range keys {
+		keyPath := path + formatKey(key)
+		if isIgnoredKey(keyPath, ignored) {
+			continue
+		}
+		expectedValue, isExpected := expected[key]
+		receivedValue, isReceived := received[key]
+		switch {
+		case !isReceived:
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected %s got nothing", keyPath, formatValue(expectedValue)))
+		case !isExpected:
+			mismatches = append(mismatches, fmt.Sprintf("%s: unexpected %s", keyPath, formatValue(receivedValue)))
+		default:
+			mismatches = append(mismatches, compareValues(keyPath, expectedValue, receivedValue, ignored)...)
+		}
+	}
+	return mismatches
+}
+
+// matchScalar returns whether the received scalar value matches the expected
+// one. Numbers are compared by value, and an expected string containing
+// {{match}} helpers matches the received value as text.
+func matchScalar(expected interface{}, received interface{}) bool {
+	if expectedString, ok := expected.(string); ok {
+		if regex, ok := scalarRegex(expectedString); ok {
+			return regex.MatchString(scalarText(received))
+		}
+	}
+
+	expectedNumber, isExpectedNumber := toNumber(expected)
+	receivedNumber, isReceivedNumber := toNumber(received)
+	if isExpectedNumber || isReceivedNumber {
+		return isExpectedNumber && isReceivedNumber && expectedNumber.Cmp(receivedNumber) == 0
+	}
+	return expected == received
+}
+
+func scalarRegex(expected string) (*regexp.Regexp, bool) {
+	pattern, hasRegex := handlebars.ExpandRegexes(regexp.QuoteMeta(expected))
+	if !hasRegex {
+		return nil, false
+	}
+	regex, err := regexp.Compile("^" + pattern + "$")
+	return regex, err == nil
+}
+
+// scalarText returns the text of a scalar value, matched with a {{match}}
+// helper.
+func scalarText(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return formatValue(value)
+}
+
+// toNumber returns the exact value of a number, to compare large integers
+// which would be rounded as float64.
+func toNumber(value interface{}) (*big.Rat, bool) {
+	switch value := value.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(string(value))
+	case int:
+		return new(big.Rat).SetInt64(int64(value)), true
+	case int64:
+		return new(big.Rat).SetInt64(value), true
+	case uint64:
+		return new(big.Rat).SetUint64(value), true
+	case float64:
+		n := new(big.Rat).SetFloat64(value)
+		return n, n != nil
+	default:
+		return nil, false
+	}
+}
+
+func mismatch(path string, expected interface{}, received interface{}) string {
+	return fmt.Sprintf("%s: expected %s got %s", path, formatValue(expected), formatValue(received))
+}
+
+// formatValue returns the JSON representation of a value in a diff, with the
+// {{match}} helpers replaced by their regex.
+func formatValue(value interface{}) string {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Sprint(value)
+	}
+	formatted, _ := handlebars.ExpandRegexes(strings.TrimSuffix(out.String(), "\n"))
+	return formatted
+}
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// formatKey returns the path component of an object key, e.g. `.title` or
+// `["first name"]`.
+func formatKey(key string) string {
+	if identifierRegex.MatchString(key) {
+		return "." + key
+	}
+	return "[" + strconv.Quote(key) + "]"
+}
+
+// compileIgnoredKeys returns the regexes matching the paths of the ignored
+// keys. A key is either a name, ignored at any depth, or a path starting with
+// `$`, where `[*]` matches any array index, e.g. `$.items[*].id`.
+func compileIgnoredKeys(keys []string) ([]*regexp.Regexp, error) {
+	regexes := []*regexp.Regexp{}
+	for _, key := range keys {
+		var pattern string
+		if strings.HasPrefix(key, "$") {
+			pattern = "^" + strings.ReplaceAll(regexp.QuoteMeta(key), `\[\*\]`, `\[\d+\]`) + "$"
+		} else {
+			pattern = regexp.QuoteMeta(formatKey(key)) + "$"
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignored key `%s`: %w", key, err)
+		}
+		regexes = append(regexes, regex)
+	}
+	return regexes, nil
+}
+
+func isIgnoredKey(path string, ignored []*regexp.Regexp) bool {
+	for _, regex := range ignored {
+		if regex.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package tesh
+
+import (
+	"testing"
+
+	"github.com/mickael-menu/tesh/pkg/internal/util/test/assert"
+)
+
+func TestCompareStructuredJSON(t *testing.T) {
+	testCompareStructured(t, JSONFormat, `{"a": 1, "b": [true, null]}`, `{"b":[true,null],"a":1.0}`, nil, []string{})
+
+	testCompareStructured(t, JSONFormat,
+		`{"first name": "a", "tags": ["x", "y"], "meta": {"n": 1}}`,
+		`{"first name": "b", "tags": ["x"], "meta": 1}`,
+		nil,
+		[]string{
+			`$["first name"]: expected "a" got "b"`,
+			`$.meta: expected {"n":1} got 1`,
+			`$.tags[1]: expected "y" got nothing`,
+		},
+	)
+
+	testCompareStructured(t, JSONFormat,
+		`{"id": 1, "items": [{"id": 2, "at": 3}], "at": 4}`,
+		`{"id": 9, "items": [{"id": 8, "at": 7}], "at": 6}`,
+		[]string{"id", "$.items[*].at"},
+		[]string{`$.at: expected 4 got 6`},
+	)
+
+	testCompareStructured(t, JSONFormat, `{"id": 9007199254740993, "n": 1e2}`, `{"id": 9007199254740992, "n": 100}`, nil, []string{
+		`$.id: expected 9007199254740993 got 9007199254740992`,
+	})
+}
+
+func TestCompareStructuredYAML(t *testing.T) {
+	testCompareStructured(t, YAMLFormat, `
+name: tesh
+tags: [cli, test]
+nested:
+  count: 2
+  ratio: 0.5
+`, `
+nested: {ratio: 0.50, count: 2}
+tags:
+  - cli
+  - test
+name: "tesh"
+`, nil, []string{})
+
+	testCompareStructured(t, YAMLFormat, "a:\n  1: one\n", "a:\n  1: two\n", nil, []string{
+		`$.a["1"]: expected "one" got "two"`,
+	})
+}
+
+func TestCompareStructuredTOML(t *testing.T) {
+	testCompareStructured(t, TOMLFormat, `
+title = "notes"
+created = 2021-01-02T03:04:05Z
+
+[[items]]
+id = 1
+`, `
+created = 2021-01-02T03:04:05Z
+title = "notes"
+items = [{ id = 1 }]
+`, nil, []string{})
+
+	testCompareStructured(t, TOMLFormat, "[server]\nport = 80\n", "[server]\nport = 8080\n", nil, []string{
+		`$.server.port: expected 80 got 8080`,
+	})
+}
+
+func TestCompareStructuredCSV(t *testing.T) {
+	testCompareStructured(t, CSVFormat, "id,title\n1,Hello\n2,World\n", "title, id\nHello, 1\nWorld, 2\n", nil, []string{})
+	testCompareStructured(t, TSVFormat, "id\ttitle\n1\tHello\n", "title\tid\nHello\t1\n", nil, []string{})
+	testCompareStructured(t, TSVFormat, "id\ttitle\tx\n1\t\t3\n", "x\ttitle\tid\n3\t\t1\n", nil, []string{})
+	testCompareStructured(t, TSVFormat, "id\ttitle\n1\t\n", "id\ttitle\n1\tHello\n", nil, []string{
+		`$[0].title: expected "" got "Hello"`,
+	})
+
+	testCompareStructured(t, CSVFormat, "id,title\n1,Hello\n2,World\n", "id,title\n1,Hello\n2,Word\n3,New\n", []string{"id"}, []string{
+		`$[1].title: expected "World" got "Word"`,
+		`$[2]: unexpected {"id":"3","title":"New"}`,
+	})
+
+	testCompareStructured(t, CSVNoHeaderFormat, "1, Hello\n2,World\n", "1,Hello\n2, World\n", nil, []string{})
+	testCompareStructured(t, TSVNoHeaderFormat, "1\t\tx\n", "1\t\ty\n", nil, []string{
+		`$[0][2]: expected "x" got "y"`,
+	})
+	testCompareStructured(t, CSVNoHeaderFormat, "id,title\n1,Hello\n", "title,id\nHello,1\n", nil, []string{
+		`$[0][0]: expected "id" got "title"`,
+		`$[0][1]: expected "title" got "id"`,
+		`$[1][0]: expected "1" got "Hello"`,
+		`$[1][1]: expected "Hello" got "1"`,
+	})
+
+	_, err := compareStructured(CSVFormat, "id,id\n1,2\n", "id\n1\n", nil)
+	assert.Err(t, err, "invalid expected csv: duplicate column: `id`")
+}
+
+func testCompareStructured(t *testing.T, format Format, expected string, received string, ignoredKeys []string, mismatches []string) {
+	actual, err := compareStructured(format, expected, received, ignoredKeys)
+	assert.Nil(t, err)
+	assert.Equal(t, actual, mismatches)
+}
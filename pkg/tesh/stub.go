@@ -0,0 +1,346 @@
+package tesh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	executil "github.com/mickael-menu/tesh/pkg/internal/util/exec"
+)
+
+// Stub is an executable shadowing a real program for the commands of a
+// test, declared with the `stub` directive.
+//
+// A stub either prints fixed outputs and exits with a fixed code, e.g.
+// `# stub: git stderr "fatal: not a git repository\n" exit 128`, or runs a
+// shell script, e.g. `# stub: editor run echo "edited" >> "$1"`.
+type Stub struct {
+	Name     string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// Script run by the stub instead of printing the fixed outputs.
+	Script string
+	// Records the standard input of each call, declared with the `stdin`
+	// option. The stub reads its whole input before running.
+	Stdin bool
+}
+
+// parseStub parses the arguments of a `stub` directive.
+func parseStub(args string) (Stub, error) {
+	args = strings.TrimSpace(args)
+	name := args
+	rest := ""
+	if i := strings.IndexAny(args, " \t"); i >= 0 {
+		name = args[:i]
+		rest = strings.TrimSpace(args[i:])
+	}
+
+	stub := Stub{Name: name}
+	if name == "" {
+		return stub, fmt.Errorf("expected the name of the stubbed executable")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return stub, fmt.Errorf("invalid executable name: `%s`", name)
+	}
+
+	if isStubOption(rest, "stdin") {
+		stub.Stdin = true
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, "stdin"))
+	}
+	if isStubOption(rest, "run") {
+		stub.Script = strings.TrimSpace(strings.TrimPrefix(rest, "run"))
+		if stub.Script == "" {
+			return stub, fmt.Errorf("expected a script to run")
+		}
+		return stub, nil
+	}
+
+	words, err := splitWords(rest)
+	if err != nil {
+		return stub, err
+	}
+	for i := 0; i < len(words); i++ {
+		option := words[i]
+		if option == "stdin" {
+			stub.Stdin = true
+			continue
+		}
+		if i+1 >= len(words) {
+			return stub, fmt.Errorf("expected a value for `%s`", option)
+		}
+		i++
+		value := words[i]
+		switch option {
+		case "stdout":
+			stub.Stdout = value
+		case "stderr":
+			stub.Stderr = value
+		case "exit":
+			stub.ExitCode, err = strconv.Atoi(value)
+			if err != nil || stub.ExitCode < 0 || stub.ExitCode > 255 {
+				return stub, fmt.Errorf("invalid exit code: `%s`", value)
+			}
+		default:
+			return stub, fmt.Errorf("unknown stub option: `%s`", option)
+		}
+	}
+	return stub, nil
+}
+
+// isStubOption returns whether the arguments of a `stub` directive start
+// with the given option.
+func isStubOption(args string, option string) bool {
+	return args == option || strings.HasPrefix(args, option+" ") || strings.HasPrefix(args, option+"\t")
+}
+
+// installStubs writes the given stubs as executables in the stubs dir of the
+// config, which is put first in the PATH of the commands. A stub replaces
+// any previous stub with the same name.
+func installStubs(stubs []Stub, config *RunConfig) error {
+	if len(stubs) == 0 {
+		return nil
+	}
+	if config.stubsDir == "" {
+		if config.stateDir == "" {
+			return fmt.Errorf("no state dir to install the stubs")
+		}
+		config.stubsDir = filepath.Join(config.stateDir, "stubs")
+		if err := os.MkdirAll(config.stubsDir, 0755); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(callsDir(*config), 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, stub := range stubs {
+		script := stub.script(callsDir(*config), cmdEnvPath(*config))
+		err := ioutil.WriteFile(filepath.Join(config.stubsDir, stub.Name), []byte(script), 0755)
+		if err != nil {
+			return fmt.Errorf("stub %s: %w", stub.Name, err)
+		}
+	}
+	return nil
+}
+
+// callsDir returns the dir where the stub calls are recorded, one numbered
+// dir per call.
+func callsDir(config RunConfig) string {
+	return filepath.Join(config.stateDir, "calls")
+}
+
+// cmdEnvPath returns the path of the file holding the environment of the
+// running command, recorded with each stub call to compare it with the
+// environment of the stub.
+func cmdEnvPath(config RunConfig) string {
+	return filepath.Join(config.stateDir, "env")
+}
+
+// writeCmdEnv records the environment of the command about to run, when it
+// can call stubs.
+func writeCmdEnv(env []string, config RunConfig) error {
+	if config.stubsDir == "" {
+		return nil
+	}
+	return ioutil.WriteFile(cmdEnvPath(config), []byte(strings.Join(env, "\n")+"\n"), 0644)
+}
+
+// script returns the content of the stub executable. Each call is recorded
+// in a new dir of callsDir, created atomically with mkdir to number the
+// calls in order, even when stubs are called concurrently.
+func (s Stub) script(callsDir string, cmdEnvPath string) string {
+	script := "#!/bin/sh\n"
+	script += "calls=" + executil.Quote(callsDir) + "\n"
+	script += "n=1\n"
+	script += "while ! mkdir \"$calls/$n\" 2>/dev/null; do n=$((n + 1)); done\n"
+	script += "call=\"$calls/$n\"\n"
+	script += "for arg in \"$@\"; do printf '%s\\000' \"$arg\"; done > \"$call/args\"\n"
+	script += "pwd > \"$call/cwd\"\n"
+	script += "env > \"$call/env\"\n"
+	script += "cp " + executil.Quote(cmdEnvPath) + " \"$call/cmd-env\" 2>/dev/null\n"
+	if s.Stdin {
+		script += "if [ -t 0 ]; then : > \"$call/stdin\"; else cat > \"$call/stdin\"; fi\n"
+	}
+	// The name is written last, to tell when the record is complete.
+	script += "printf '%s' " + executil.Quote(s.Name) + " > \"$call/name\"\n"
+
+	if s.Script != "" {
+		if s.Stdin {
+			return script + "(\n" + s.Script + "\n) < \"$call/stdin\"\n"
+		}
+		// The script reads the input of the call directly, which is not
+		// recorded.
+		return script + "(\n" + s.Script + "\n)\n"
+	}
+	if s.Stdout != "" {
+		script += "printf '%s' " + executil.Quote(s.Stdout) + "\n"
+	}
+	if s.Stderr != "" {
+		script += "printf '%s' " + executil.Quote(s.Stderr) + " >&2\n"
+	}
+	return script + fmt.Sprintf("exit %d\n", s.ExitCode)
+}
+
+// stubCall is an invocation of a stub, recorded by its script.
+type stubCall struct {
+	Name string
+	Args []string
+	Cwd  string
+	Env  map[string]string
+	// Environment of the command which called the stub.
+	CmdEnv map[string]string
+	Stdin  string
+}
+
+// readStubCalls returns the calls recorded so far, in order. The calls
+// being recorded are ignored.
+func readStubCalls(config RunConfig) []stubCall {
+	calls := []stubCall{}
+	if config.stubsDir == "" {
+		return calls
+	}
+	for n := 1; ; n++ {
+		dir := filepath.Join(callsDir(config), strconv.Itoa(n))
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return calls
+		}
+		call, ok := readStubCall(dir)
+		if !ok {
+			// The stub is still recording this call.
+			return calls
+		}
+		calls = append(calls, call)
+	}
+}
+
+// readStubCall reads the call recorded in the given dir, or returns false if
+// the record is not complete yet.
+func readStubCall(dir string) (stubCall, bool) {
+	call := stubCall{}
+	read := func(name string) string {
+		content, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		return string(content)
+	}
+
+	call.Name = read("name")
+	if call.Name == "" {
+		return call, false
+	}
+	call.Args = []string{}
+	if args := read("args"); args != "" {
+		call.Args = strings.Split(strings.TrimSuffix(args, "\x00"), "\x00")
+	}
+	call.Cwd = strings.TrimSuffix(read("cwd"), "\n")
+	call.Env = parseEnv(read("env"))
+	call.CmdEnv = parseEnv(read("cmd-env"))
+	call.Stdin = read("stdin")
+	return call, true
+}
+
+// parseEnv parses the output of `env`. Lines which don't start with a
+// variable name are part of the previous multi-line value.
+func parseEnv(output string) map[string]string {
+	env := map[string]string{}
+	last := ""
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if match := envLineRegex.FindStringSubmatch(line); match != nil {
+			last = match[1]
+			env[last] = match[2]
+		} else if last != "" {
+			env[last] += "\n" + line
+		}
+	}
+	return env
+}
+
+var envLineRegex = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// shellEnvVars are set by the shell running the stubs, and ignored when
+// comparing their environment with the one of the commands.
+var shellEnvVars = map[string]bool{
+	"PWD":    true,
+	"OLDPWD": true,
+	"SHLVL":  true,
+	"_":      true,
+}
+
+// runCallsCmd implements the `tesh-calls [<name>...]` builtin, printing the
+// recorded calls of the given stubs, or of all of them. Each call is printed
+// with its arguments, followed by the working dir, environment variables and
+// standard input which differ from the ones of the calling command.
+func runCallsCmd(args []string, stdin string, config RunConfig) (cmdResult, error) {
+	calls := readStubCalls(config)
+
+	names := map[string]bool{}
+	for _, name := range args {
+		names[name] = true
+	}
+
+	out := ""
+	for _, call := range calls {
+		if len(names) > 0 && !names[call.Name] {
+			continue
+		}
+
+		out += call.Name
+		for _, arg := range call.Args {
+			out += " " + executil.Quote(arg)
+		}
+		out += "\n"
+
+		if cwd := relativeCwd(call.Cwd, config.WorkingDir); cwd != "." {
+			out += "  cwd: " + cwd + "\n"
+		}
+		for _, line := range envDelta(call.CmdEnv, call.Env) {
+			out += "  env: " + line + "\n"
+		}
+		if call.Stdin != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(call.Stdin, "\n"), "\n") {
+				out += "  stdin: " + line + "\n"
+			}
+		}
+	}
+	return cmdResult{Stdout: out}, nil
+}
+
+// relativeCwd returns the working dir of a call relative to the working dir
+// of the commands, or as is when outside of it.
+func relativeCwd(cwd string, workingDir string) string {
+	if workingDir == "" {
+		return cwd
+	}
+	rel, err := filepath.Rel(workingDir, cwd)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return cwd
+	}
+	return rel
+}
+
+// envDelta returns the variables of env which were added, modified or
+// removed compared to base, sorted by name.
+func envDelta(base map[string]string, env map[string]string) []string {
+	delta := []string{}
+	for name, value := range env {
+		if shellEnvVars[name] {
+			continue
+		}
+		if baseValue, ok := base[name]; !ok || baseValue != value {
+			delta = append(delta, name+"="+value)
+		}
+	}
+	for name := range base {
+		if _, ok := env[name]; !ok && !shellEnvVars[name] {
+			delta = append(delta, "-"+name)
+		}
+	}
+	sort.Slice(delta, func(i, j int) bool {
+		return strings.TrimPrefix(delta[i], "-") < strings.TrimPrefix(delta[j], "-")
+	})
+	return delta
+}
@@ -0,0 +1,43 @@
+package tesh
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mickael-menu/tesh/pkg/internal/util/test/assert"
+)
+
+func TestReadStubCalls(t *testing.T) {
+	dir := t.TempDir()
+	config := RunConfig{stateDir: dir, stubsDir: filepath.Join(dir, "stubs")}
+	assert.Equal(t, readStubCalls(config), []stubCall{})
+
+	// The second call is still being recorded: its name is written last, so
+	// it is ignored with the following calls until the record is complete.
+	writeFiles(t, callsDir(config), map[string]string{
+		"1/name":  "git",
+		"1/args":  "status\x00-s\x00",
+		"1/cwd":   "/work\n",
+		"1/env":   "A=1\n",
+		"1/stdin": "input\n",
+		"2/args":  "open\x00",
+		"2/cwd":   "/work\n",
+		"3/name":  "git",
+	})
+	assert.Equal(t, readStubCalls(config), []stubCall{
+		{
+			Name:   "git",
+			Args:   []string{"status", "-s"},
+			Cwd:    "/work",
+			Env:    map[string]string{"A": "1"},
+			CmdEnv: map[string]string{},
+			Stdin:  "input\n",
+		},
+	})
+
+	writeFiles(t, callsDir(config), map[string]string{"2/name": "editor"})
+	calls := readStubCalls(config)
+	assert.Equal(t, len(calls), 3)
+	assert.Equal(t, calls[1].Name, "editor")
+	assert.Equal(t, calls[1].Args, []string{"open"})
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/mickael-menu/tesh/pkg/tesh"
 )
@@ -16,37 +18,98 @@ func main() {
 	flag.BoolVar(&update, "u", false, "overwrite test cases instead of failing")
 	var printBytes bool
 	flag.BoolVar(&printBytes, "b", false, "print bytes instead of strings")
+	var wd string
+	flag.StringVar(&wd, "wd", "", "directory or archive copied as the working dir of each test")
+	var run string
+	flag.StringVar(&run, "run", "", "run only the tests with a name matching this regex")
+	var tags string
+	flag.StringVar(&tags, "tags", "", "run only the tests with one of these comma-separated tags")
+	var skipTags string
+	flag.StringVar(&skipTags, "skip-tags", "", "skip the tests with one of these comma-separated tags")
+	var shell string
+	flag.StringVar(&shell, "shell", "", "shell used to run the commands, with its options (default $SHELL)")
+	var fixtureStrategy string
+	flag.StringVar(&fixtureStrategy, "fixture-strategy", "copy", "how the working dir files are installed for each test: copy, hardlink or reflink")
+	var keep bool
+	flag.BoolVar(&keep, "keep", false, "keep the temporary working dirs")
+	var keepOnFailure bool
+	flag.BoolVar(&keepOnFailure, "keep-on-failure", false, "keep the temporary working dirs of the failed tests")
+	var debug bool
+	flag.BoolVar(&debug, "debug", false, "start a shell in the working dir of a failed command")
+	var matrix matrixFlag
+	flag.Var(&matrix, "matrix", "run each test with this shell and/or `KEY=value` variables, can be repeated")
 	flag.Parse()
 
 	values := flag.Args()
 
 	if len(values) == 0 {
-		fmt.Println("usage: tesh [-u] <tests> [<working-dir>]")
+		fmt.Println("usage: tesh [-u] <tests>... [<working-dir>]")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	testsDir := values[0]
-	wd := ""
-	if len(values) >= 2 {
-		wd, err = filepath.Abs(values[1])
+	// For backward compatibility, the working dir can be given after a
+	// single tests dir. With more tests, it must be set with -wd, as the
+	// last argument could also be a test.
+	if wd == "" && len(values) >= 2 {
+		last := values[len(values)-1]
+		if len(values) == 2 && isDir(values[0]) && filepath.Ext(last) != ".tesh" {
+			wd = last
+			values = values[:1]
+		} else if isWorkingDir(last) {
+			exit(fmt.Sprintf("%s: ambiguous argument, use -wd to run the tests from this working dir", last))
+		}
+	}
+	if wd != "" {
+		wd, err = filepath.Abs(wd)
+		exitIfErr(err)
+	}
+
+	filter := tesh.Filter{
+		Tags:     splitFlag(tags),
+		SkipTags: splitFlag(skipTags),
+	}
+	if run != "" {
+		filter.Run, err = regexp.Compile(run)
 		exitIfErr(err)
 	}
 
-	suite, err := tesh.ParseSuite(testsDir)
+	keepMode := tesh.KeepNever
+	if keep {
+		keepMode = tesh.KeepAlways
+	} else if keepOnFailure {
+		keepMode = tesh.KeepOnFailure
+	}
+
+	suite, err := tesh.ParseSuite(values...)
 	exitIfErr(err)
+	suite = suite.Filter(filter)
 	report, err := tesh.RunSuite(suite, tesh.RunConfig{
-		Update:     update,
-		WorkingDir: wd,
+		Update:          update,
+		WorkingDir:      wd,
+		Shell:           strings.Fields(shell),
+		Matrix:          matrix,
+		Keep:            keepMode,
+		FixtureStrategy: fixtureStrategy,
+		Debug:           debug,
 		Callbacks: tesh.RunCallbacks{
 			OnFinishCommand: func(test tesh.TestNode, cmd tesh.CommandNode, config tesh.RunConfig, err error) {
-				if err != nil {
+				// The failure of a test marked with `xfail` is expected, and
+				// reported with XFAIL when the test finishes.
+				if err != nil && !test.XFail.Set {
 					fmt.Printf("FAIL %s: $ %s\n", test.Name, cmd.Cmd)
 					switch err := err.(type) {
 					case tesh.ExitCodeAssertError:
 						fmt.Printf("\t%s\n", err)
 					case tesh.DataAssertError:
-						fmt.Printf("expected on %s:\n---\n", err.FD.String())
+						if len(err.Mismatches) > 0 {
+							fmt.Printf("mismatches on %s:\n", err.Target())
+							for _, mismatch := range err.Mismatches {
+								fmt.Printf("\t%s\n", mismatch)
+							}
+							break
+						}
+						fmt.Printf("expected on %s:\n---\n", err.Target())
 						if printBytes {
 							fmt.Println([]byte(err.Expected))
 						}
@@ -60,24 +123,101 @@ func main() {
 					}
 				}
 			},
+			OnKeepWorkingDir: func(test tesh.TestNode, dir string) {
+				fmt.Printf("KEPT %s: %s\n", test.Name, dir)
+				script := filepath.Join(dir, tesh.ReproScriptName)
+				if _, err := os.Stat(script); err == nil {
+					fmt.Printf("\treproduce the failure with: %s\n", script)
+				}
+			},
+			OnDebugCommand: func(test tesh.TestNode, cmd tesh.CommandNode, config tesh.RunConfig) {
+				fmt.Printf("DEBUG %s: starting a shell in %s\n", test.Name, config.WorkingDir)
+				fmt.Println("\texit to resume the tests, or exit with a non-zero status to abort")
+			},
+			OnSkipCommand: func(test tesh.TestNode, cmd tesh.CommandNode, reason string) {
+				fmt.Printf("SKIP %s: $ %s%s\n", test.Name, cmd.Cmd, formatReason(reason))
+			},
 			OnFinishTest: func(test tesh.TestNode, err error) {
-				if err == nil {
+				switch err := err.(type) {
+				case nil:
 					fmt.Printf("OK %s\n", test.Name)
+				case tesh.SkipError:
+					fmt.Printf("SKIP %s%s\n", test.Name, formatReason(err.Reason))
+				case tesh.XFailError:
+					fmt.Printf("XFAIL %s%s\n", test.Name, formatReason(err.Reason))
+				case tesh.UnexpectedPassError, tesh.SetupError:
+					fmt.Printf("FAIL %s: %s\n", test.Name, err)
 				}
 			},
 		},
 	})
 	exitIfErr(err)
+	details := ""
+	if report.SkippedCount > 0 {
+		details += fmt.Sprintf(", %d skipped", report.SkippedCount)
+	}
+	if report.XFailCount > 0 {
+		details += fmt.Sprintf(", %d expected failures", report.XFailCount)
+	}
 	if update && report.UpdatedCount > 0 {
-		fmt.Printf("UPDATED %d on %d tests\n", report.UpdatedCount, report.TotalCount)
+		fmt.Printf("UPDATED %d on %d tests%s\n", report.UpdatedCount, report.TotalCount, details)
 	} else if report.FailedCount == 0 {
-		fmt.Printf("PASSED %d tests\n", report.TotalCount)
+		fmt.Printf("PASSED %d tests%s\n", report.PassedCount(), details)
 	} else {
-		fmt.Printf("FAILED %d on %d tests\n", report.FailedCount, report.TotalCount)
+		fmt.Printf("FAILED %d on %d tests%s\n", report.FailedCount, report.TotalCount, details)
 		os.Exit(1)
 	}
 }
 
+func formatReason(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
+
+// matrixFlag collects the entries given with repeated -matrix flags.
+type matrixFlag []tesh.MatrixEntry
+
+func (f *matrixFlag) String() string {
+	return ""
+}
+
+func (f *matrixFlag) Set(value string) error {
+	*f = append(*f, tesh.ParseMatrixEntry(value))
+	return nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// isWorkingDir returns whether the given path is a fixture archive, or a
+// directory which doesn't contain any .tesh file.
+func isWorkingDir(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if !info.IsDir() {
+		return tesh.IsFixtureArchive(path)
+	}
+	suite, err := tesh.ParseSuite(path)
+	return err == nil && suite.IsEmpty()
+}
+
+func splitFlag(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func exitIfErr(err error) {
 	if err != nil {
 		exit(err.Error())